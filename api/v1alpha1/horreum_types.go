@@ -18,6 +18,7 @@ package v1alpha1
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -27,10 +28,15 @@ type DatabaseSpec struct {
 	Host string `json:"host,omitempty"`
 	// Database port; defaults to 5432
 	Port int32 `json:"port,omitempty"`
-	// Name of the database
+	// Name of the database; on shared PostgreSQL the name is prefixed with the namespace
 	Name string `json:"name,omitempty"`
 	// Name of secret resource with data `username` and `password`. Created if does not exist.
+	// On shared PostgreSQL `username` is ignored; the user is named `<namespace>-<secret>`.
 	Secret string `json:"secret,omitempty"`
+	// PostgreSQL sslmode of the connection. Modes `verify-ca` and `verify-full` verify the server certificate
+	// against `trustedCABundle`, which must be set. Defaults to the driver default (`prefer`).
+	// +kubebuilder:validation:Enum=disable;prefer;require;verify-ca;verify-full
+	SSLMode string `json:"sslMode,omitempty"`
 }
 
 // RouteSpec defines the route for external access.
@@ -51,10 +57,81 @@ type ExternalSpec struct {
 	InternalUri string `json:"internalUri,omitempty"`
 }
 
+// SharedKeycloakSpec references Keycloak deployed by another Horreum resource
+type SharedKeycloakSpec struct {
+	// Name of the Horreum resource that deploys Keycloak
+	Horreum string `json:"horreum"`
+	// Namespace of the Horreum resource; defaults to the namespace of this resource
+	Namespace string `json:"namespace,omitempty"`
+	// Realm provisioned for this instance in the shared Keycloak; defaults to `<namespace>-<name>`.
+	// Realms `master` and `horreum` are reserved.
+	// +kubebuilder:validation:Pattern=`^[a-zA-Z0-9_-]+$`
+	Realm string `json:"realm,omitempty"`
+}
+
+// SchedulingSpec defines constraints for placement of the pods
+type SchedulingSpec struct {
+	// Selector which must match labels of the node the pod is scheduled on
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// Tolerations of node taints
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+	// Node and pod (anti-)affinity rules
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+	// Constraints for spreading the pods across topology domains
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+	// Name of the priority class for the pods
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+}
+
+// PodCustomizationSpec defines additions to the pods generated by the operator
+type PodCustomizationSpec struct {
+	// Additional environment variables for the main container. Variables set by the operator cannot be overridden.
+	ExtraEnv []corev1.EnvVar `json:"extraEnv,omitempty"`
+	// Additional volumes added to the pod
+	// +kubebuilder:validation:Schemaless
+	// +kubebuilder:validation:Type=array
+	// +kubebuilder:pruning:PreserveUnknownFields
+	ExtraVolumes []corev1.Volume `json:"extraVolumes,omitempty"`
+	// Additional volume mounts for the main container
+	ExtraVolumeMounts []corev1.VolumeMount `json:"extraVolumeMounts,omitempty"`
+	// Additional containers running alongside the main container (e.g. log shippers)
+	// +kubebuilder:validation:Schemaless
+	// +kubebuilder:validation:Type=array
+	// +kubebuilder:pruning:PreserveUnknownFields
+	Sidecars []corev1.Container `json:"sidecars,omitempty"`
+	// Additional init containers, executed after those defined by the operator
+	// +kubebuilder:validation:Schemaless
+	// +kubebuilder:validation:Type=array
+	// +kubebuilder:pruning:PreserveUnknownFields
+	ExtraInitContainers []corev1.Container `json:"extraInitContainers,omitempty"`
+	// Additional labels of the pod. Labels set by the operator cannot be overridden.
+	PodLabels map[string]string `json:"podLabels,omitempty"`
+	// Additional annotations of the pod
+	PodAnnotations map[string]string `json:"podAnnotations,omitempty"`
+	// Secrets used to pull the images, e.g. from a private mirror registry
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+}
+
+// ProbesSpec overrides default health probes of the component's main container
+type ProbesSpec struct {
+	// Liveness probe; the container is restarted when it fails
+	Liveness *corev1.Probe `json:"liveness,omitempty"`
+	// Readiness probe; the pod does not receive traffic and is not considered ready until it succeeds
+	Readiness *corev1.Probe `json:"readiness,omitempty"`
+	// Startup probe; other probes are not executed until it succeeds
+	Startup *corev1.Probe `json:"startup,omitempty"`
+}
+
 // KeycloakSpec defines Keycloak setup
 type KeycloakSpec struct {
 	// When this is set Keycloak instance will not be deployed and Horreum will use this external instance.
 	External ExternalSpec `json:"external,omitempty"`
+	// When this is set Keycloak instance will not be deployed; the operator provisions a realm
+	// and clients for this instance in Keycloak deployed by another Horreum resource.
+	Shared *SharedKeycloakSpec `json:"shared,omitempty"`
+	// Namespaces of Horreum resources permitted to provision realms in Keycloak of this resource
+	// through `shared`; resources in the same namespace are always permitted.
+	SharedNamespaces []string `json:"sharedNamespaces,omitempty"`
 	// Image that should be used for Keycloak deployment. Defaults to quay.io/keycloak/keycloak:latest
 	Image string `json:"image,omitempty"`
 	// Route for external access to the Keycloak instance.
@@ -66,14 +143,71 @@ type KeycloakSpec struct {
 	AdminSecret string `json:"adminSecret,omitempty"`
 	// Database coordinates Keycloak should use
 	Database DatabaseSpec `json:"database,omitempty"`
+	// Reverse proxy mode: 'edge', 'reencrypt', 'passthrough' or 'none'. By default this is derived from the way
+	// Keycloak is exposed: the route type for routes ('reencrypt' when the type is not set), 'passthrough' for
+	// LoadBalancer services (clients connect to Keycloak HTTPS port through the load balancer) and 'none'
+	// for NodePort services. Mode 'edge' enables plain-text HTTP on service port `http` (port 80 targeting
+	// 8080). When Keycloak is exposed through an ingress created outside the operator set 'edge' if the ingress
+	// terminates TLS and forwards to port `http`, 'reencrypt' if it forwards to port `https`, or 'passthrough'
+	// for TLS passthrough.
+	// +kubebuilder:validation:Enum=edge;reencrypt;passthrough;none
+	Proxy string `json:"proxy,omitempty"`
+	// Hostname Keycloak uses in the URLs it generates. Defaults to the host of Keycloak public URL.
+	Hostname string `json:"hostname,omitempty"`
+	// When false Keycloak accepts requests for any hostname. Keycloak defaults to true.
+	HostnameStrict *bool `json:"hostnameStrict,omitempty"`
+	// When false Keycloak may generate plain-text HTTP URLs for the hostname. Keycloak defaults to true.
+	HostnameStrictHttps *bool `json:"hostnameStrictHttps,omitempty"`
+	// Verification of Keycloak certificate by Horreum: 'none' (default), 'certificate-validation' or 'required'
+	// (which verifies also the hostname). Certificates are verified against the JVM truststore with CAs from
+	// `trustedCABundle` added; on OpenShift the bundle must include the service CA to verify Keycloak deployed
+	// by the operator.
+	// +kubebuilder:validation:Enum=none;certificate-validation;required
+	TLSVerification string `json:"tlsVerification,omitempty"`
+	// Compute resources required by Keycloak container
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Scheduling constraints for Keycloak pod
+	SchedulingSpec `json:",inline"`
+	// Overrides for the default probes using Keycloak health endpoints
+	Probes ProbesSpec `json:"probes,omitempty"`
+	// Customizations of Keycloak pod
+	PodCustomizationSpec `json:",inline"`
+}
+
+// SharedPostgresSpec references PostgreSQL server shared with other Horreum instances
+type SharedPostgresSpec struct {
+	// Name of the Horreum resource that deploys PostgreSQL; mutually exclusive with `host`
+	Horreum string `json:"horreum,omitempty"`
+	// Namespace of the Horreum resource; defaults to the namespace of this resource
+	Namespace string `json:"namespace,omitempty"`
+	// Hostname of external PostgreSQL server
+	Host string `json:"host,omitempty"`
+	// Port of external PostgreSQL server; defaults to 5432
+	Port int32 `json:"port,omitempty"`
+	// Secret with keys `username` and `password` of external server user permitted to create databases
+	// and roles. Admin credentials of the Horreum resource are used when `horreum` is set.
+	AdminSecret string `json:"adminSecret,omitempty"`
 }
 
 // PostgresSpec defines PostgreSQL database setup
 type PostgresSpec struct {
 	// True (or omitted) to deploy PostgreSQL database
 	Enabled *bool `json:"enabled,omitempty"`
-	// Image used for PostgreSQL deployment. Defaults to registry.redhat.io/rhel8/postgresql-12:latest
+	// When this is set PostgreSQL will not be deployed; the operator creates databases and roles
+	// for this instance on the shared server using a Job, and drops them when the resource is deleted.
+	Shared *SharedPostgresSpec `json:"shared,omitempty"`
+	// Namespaces of Horreum resources permitted to create databases on PostgreSQL of this resource
+	// through `shared`; resources in the same namespace are always permitted.
+	SharedNamespaces []string `json:"sharedNamespaces,omitempty"`
+	// Image used for PostgreSQL deployment. Defaults to the image of the selected profile.
 	Image string `json:"image,omitempty"`
+	// Family of the image that determines environment variables, data and init directories and user:
+	// `upstream` (docker.io/library/postgres), `redhat` (registry.redhat.io/rhel8/postgresql-12)
+	// or `bitnami` (docker.io/bitnami/postgresql).
+	// When omitted the profile is detected from the image, falling back to `redhat` on OpenShift
+	// and `upstream` elsewhere.
+	// +kubebuilder:validation:Enum=upstream;redhat;bitnami
+	ImageProfile string `json:"imageProfile,omitempty"`
 	// Secret used for unrestricted access to the database. Created if does not exist.
 	// Must contain keys `username` and `password`.
 	AdminSecret string `json:"adminSecret,omitempty"`
@@ -81,6 +215,80 @@ type PostgresSpec struct {
 	PersistentVolumeClaim string `json:"persistentVolumeClaim,omitempty"`
 	// Id of the user the container should run as
 	User *int64 `json:"user,omitempty"`
+	// Compute resources required by PostgreSQL containers (including the init container)
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Scheduling constraints for PostgreSQL pod
+	SchedulingSpec `json:",inline"`
+	// Overrides for the default probes using `pg_isready`
+	Probes ProbesSpec `json:"probes,omitempty"`
+	// Customizations of PostgreSQL pod
+	PodCustomizationSpec `json:",inline"`
+}
+
+// NetworkPolicySpec defines isolation of components: PostgreSQL accepts connections only from Horreum and Keycloak,
+// Keycloak from Horreum and the ingress path, Horreum from the ingress path. Monitoring is allowed when enabled.
+type NetworkPolicySpec struct {
+	// Peers representing the ingress controller. When empty the OpenShift router is allowed if the service is exposed
+	// through a route; otherwise exposed services accept connections from any source.
+	Ingress []networkingv1.NetworkPolicyPeer `json:"ingress,omitempty"`
+	// Additional peers allowed to connect to Horreum application, e.g. Hyperfoil uploading results
+	App []networkingv1.NetworkPolicyPeer `json:"app,omitempty"`
+	// Additional peers allowed to connect to Keycloak
+	Keycloak []networkingv1.NetworkPolicyPeer `json:"keycloak,omitempty"`
+	// Additional peers allowed to connect to PostgreSQL, e.g. backup tools
+	Database []networkingv1.NetworkPolicyPeer `json:"database,omitempty"`
+}
+
+// AutoscalingSpec defines horizontal autoscaling of Horreum application
+type AutoscalingSpec struct {
+	// Minimum number of replicas; defaults to 1
+	// +kubebuilder:validation:Minimum=1
+	MinReplicas *int32 `json:"minReplicas,omitempty"`
+	// Maximum number of replicas
+	// +kubebuilder:validation:Minimum=1
+	MaxReplicas int32 `json:"maxReplicas"`
+	// Target average CPU utilization, in percents of requested CPU; defaults to 80
+	TargetCPUUtilizationPercentage *int32 `json:"targetCPUUtilizationPercentage,omitempty"`
+}
+
+// MonitoringSpec defines integration with Prometheus Operator
+type MonitoringSpec struct {
+	// When true the operator creates ServiceMonitor scraping Horreum and Keycloak metrics
+	// and PrometheusRule with alerts. Ignored when monitoring.coreos.com API is not available.
+	Enabled bool `json:"enabled,omitempty"`
+	// Scrape interval, e.g. `30s`. Defaults to Prometheus configuration.
+	Interval string `json:"interval,omitempty"`
+	// Additional labels for ServiceMonitor and PrometheusRule, e.g. to match Prometheus selectors
+	Labels map[string]string `json:"labels,omitempty"`
+	// Days before certificate expiration when an alert fires; defaults to 14. The alert is defined in rules
+	// installed with the operator (config/prometheus) as it uses metrics of the operator.
+	// +kubebuilder:validation:Minimum=1
+	CertificateExpiryDays *int32 `json:"certificateExpiryDays,omitempty"`
+	// Percentage of free space on database persistent volume below which an alert fires; defaults to 10
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=99
+	DiskFreePercentage *int32 `json:"diskFreePercentage,omitempty"`
+}
+
+// TracingSpec defines export of OpenTelemetry traces
+type TracingSpec struct {
+	// URL of OTLP collector, e.g. `http://jaeger-collector:4317`
+	Endpoint string `json:"endpoint"`
+	// OTLP protocol: `grpc` (default) or `http/protobuf`
+	// +kubebuilder:validation:Enum=grpc;http/protobuf
+	Protocol string `json:"protocol,omitempty"`
+	// Ratio of sampled traces (root spans), between 0 and 1; defaults to 1 (sample everything)
+	// +kubebuilder:validation:Pattern=`^(0(\.[0-9]+)?|1(\.0+)?)$`
+	SamplerRatio string `json:"samplerRatio,omitempty"`
+	// Name of secret with key `headers` containing comma-separated `name=value` pairs sent with each
+	// export request (e.g. authorization). Not supported by Keycloak.
+	HeadersSecret string `json:"headersSecret,omitempty"`
+}
+
+// ObservabilitySpec defines observability of Horreum components and the operator
+type ObservabilitySpec struct {
+	// When set Horreum, Keycloak and the operator reconciling this resource export traces
+	Tracing *TracingSpec `json:"tracing,omitempty"`
 }
 
 // HorreumSpec defines the desired state of Horreum
@@ -93,8 +301,34 @@ type HorreumSpec struct {
 	Route RouteSpec `json:"route,omitempty"`
 	// Alternative service type when routes are not available (e.g. on vanilla K8s)
 	ServiceType corev1.ServiceType `json:"serviceType,omitempty"`
-	// Horreum image. Defaults to quay.io/hyperfoil/horreum:latest
+	// Horreum version, e.g. `0.7.5`. Selects tags of default Horreum and Keycloak images; once the version
+	// is running the images are pinned to the resolved digests. Changing the version performs an ordered
+	// upgrade: database volume snapshot, stopping the application and migrating the database with a single
+	// replica of the new version, Keycloak and scaling out the new application. Without version the `latest` images are used.
+	Version string `json:"version,omitempty"`
+	// Time each upgrade phase has to become ready; otherwise the previous application version is restored
+	// (database and Keycloak are not restored automatically). Defaults to 15 minutes.
+	UpgradeTimeout *metav1.Duration `json:"upgradeTimeout,omitempty"`
+	// Horreum image. Defaults to quay.io/hyperfoil/horreum:latest (or the tag matching version)
 	Image string `json:"image,omitempty"`
+	// Number of Horreum application replicas; defaults to 1. Ignored when autoscaling is set.
+	// +kubebuilder:validation:Minimum=0
+	Replicas *int32 `json:"replicas,omitempty"`
+	// When set the operator creates HorizontalPodAutoscaler for Horreum application. Note that
+	// the CPU utilization is computed from CPU requests of the container.
+	Autoscaling *AutoscalingSpec `json:"autoscaling,omitempty"`
+	// Quarkus and Horreum configuration properties (e.g. `quarkus.log.level: DEBUG`) rendered into
+	// `application.properties` of the application. Properties set by the operator through environment variables
+	// cannot be overridden. Any change causes restart of the application.
+	Config map[string]string `json:"config,omitempty"`
+	// Compute resources required by Horreum containers (including the init container)
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Scheduling constraints for Horreum pods
+	SchedulingSpec `json:",inline"`
+	// Overrides for the default probes using Quarkus health endpoints
+	Probes ProbesSpec `json:"probes,omitempty"`
+	// Customizations of Horreum pods. Java options can be also set through annotation `java-options` on this resource.
+	PodCustomizationSpec `json:",inline"`
 	// Database coordinates for Horreum data. Besides `username` and `password` the secret must
 	// also contain key `dbsecret` that will be used to sign access to the database.
 	Database DatabaseSpec `json:"database,omitempty"`
@@ -104,11 +338,79 @@ type HorreumSpec struct {
 	Postgres PostgresSpec `json:"postgres,omitempty"`
 	// Host used for NodePort services
 	NodeHost string `json:"nodeHost,omitempty"`
+	// Name of config map with key `ca-bundle.crt` containing PEM-encoded certificates of additional CAs
+	// (e.g. corporate CA signing external Keycloak or database). The bundle is added to truststores of Horreum
+	// and Keycloak and used to verify the database with `sslMode` `verify-ca` or `verify-full`.
+	TrustedCABundle string `json:"trustedCABundle,omitempty"`
+	// Prometheus monitoring of this instance
+	Monitoring MonitoringSpec `json:"monitoring,omitempty"`
+	// When set the operator creates NetworkPolicies restricting ingress traffic to the components
+	NetworkPolicy *NetworkPolicySpec `json:"networkPolicy,omitempty"`
+	// Tracing and other observability settings
+	Observability ObservabilitySpec `json:"observability,omitempty"`
+	// When true the operator does not create, update or delete any objects of this resource
+	// and only refreshes its status. Useful e.g. during manual maintenance of the database.
+	// A resource deleted while paused is not removed until it is resumed.
+	Paused bool `json:"paused,omitempty"`
+	// Operation mode: `Running` (default) runs all components, `Maintenance` stops Horreum application
+	// and Keycloak but keeps the database running (e.g. for migrations or dumps), `Stopped` stops
+	// all components. Secrets, services and persistent volume claims are kept in all modes. `Stopped` is
+	// rejected when the operator runs the database without a persistent volume claim.
+	// +kubebuilder:validation:Enum=Running;Maintenance;Stopped
+	Mode string `json:"mode,omitempty"`
+	// What happens with generated secrets (credentials and CA) and database persistent volume claim when
+	// this resource is deleted: `Delete` (default) lets them be garbage-collected with the resource,
+	// `Retain` keeps them, `Snapshot` copies the secrets into a backup secret and creates a VolumeSnapshot
+	// of the database PVC (when the snapshot API is available) before the originals are removed.
+	// +kubebuilder:validation:Enum=Delete;Retain;Snapshot
+	DeletionPolicy string `json:"deletionPolicy,omitempty"`
+	// When true the admission webhook rejects deletion of this resource and of the database
+	// persistent volume claim. The flag must be cleared before the resource can be deleted.
+	// The operator labels the claim with `app` if it has no such label; the webhook ignores claims without it.
+	DeletionProtection bool `json:"deletionProtection,omitempty"`
+}
+
+// VersionStatus describes images of deployed Horreum version
+type VersionStatus struct {
+	// Version from spec
+	Version string `json:"version,omitempty"`
+	// Horreum image reference, preferably by digest
+	AppImage string `json:"appImage,omitempty"`
+	// Keycloak image reference, preferably by digest. Empty when Keycloak is external.
+	KeycloakImage string `json:"keycloakImage,omitempty"`
+}
+
+// UpgradeStatus describes ongoing or failed upgrade
+type UpgradeStatus struct {
+	// Version being installed
+	TargetVersion string `json:"targetVersion"`
+	// One of Backup, Migration, Keycloak, App or RolledBack
+	Phase string `json:"phase"`
+	// When the current phase started
+	PhaseStarted metav1.Time `json:"phaseStarted,omitempty"`
+	// Name of VolumeSnapshot with database backup taken before the upgrade
+	Backup string `json:"backup,omitempty"`
+	// True when the application of previous version has been stopped for the migration
+	Stopped bool `json:"stopped,omitempty"`
+	// Horreum image of the target version by digest, pinned once the migration runs it
+	AppImage string `json:"appImage,omitempty"`
+	// Keycloak image of the target version by digest, pinned once Keycloak runs it
+	KeycloakImage string `json:"keycloakImage,omitempty"`
+}
+
+// SharedKeycloakStatus describes realm provisioned in Keycloak deployed by another Horreum resource
+type SharedKeycloakStatus struct {
+	// Horreum resource deploying the Keycloak, as `<namespace>/<name>`
+	Horreum string `json:"horreum"`
+	// Name of the realm
+	Realm string `json:"realm"`
+	// Horreum URL the clients in the realm were provisioned for
+	RedirectUrl string `json:"redirectUrl"`
 }
 
 // HorreumStatus defines the observed state of Horreum
 type HorreumStatus struct {
-	// Ready, Pending or Error.
+	// Ready, Pending, Error, Paused, Maintenance or Stopped.
 	Status string `json:"status,omitempty"`
 	// Last time state has changed.
 	LastUpdate metav1.Time `json:"lastUpdate,omitempty"`
@@ -118,6 +420,19 @@ type HorreumStatus struct {
 	PublicUrl string `json:"publicUrl,omitempty"`
 	// Public URL of Keycloak
 	KeycloakUrl string `json:"keycloakUrl,omitempty"`
+	// Version that is currently running, with images pinned to digests
+	Current VersionStatus `json:"current,omitempty"`
+	// Progress of upgrade to another version
+	Upgrade *UpgradeStatus `json:"upgrade,omitempty"`
+	// Realm provisioned in shared Keycloak
+	SharedKeycloak *SharedKeycloakStatus `json:"sharedKeycloak,omitempty"`
+	// True once databases and roles were provisioned on shared PostgreSQL; these are dropped on deletion only then
+	SharedDatabaseProvisioned bool `json:"sharedDatabaseProvisioned,omitempty"`
+	// Latest observations of the resource state, e.g. condition `Paused`
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -128,6 +443,7 @@ type HorreumStatus struct {
 // +kubebuilder:categories=all,hyperfoil
 // +kubebuilder:resource:shortName=hrm
 // +kubebuilder:printcolumn:name="Status",type="string",JSONPath=".status.status",description="Overall status"
+// +kubebuilder:printcolumn:name="Version",type="string",JSONPath=".status.current.version",description="Running version"
 // +kubebuilder:printcolumn:name="Reason",type="string",JSONPath=".status.reason",description="Reason for status"
 // +kubebuilder:printcolumn:name="URL",type="string",JSONPath=".status.publicUrl",description="Horreum URL"
 // +kubebuilder:printcolumn:name="Keycloak URL",type="string",JSONPath=".status.keycloakUrl",description="Keycloak URL"
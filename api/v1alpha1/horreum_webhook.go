@@ -0,0 +1,95 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+var horreumlog = logf.Log.WithName("horreum-resource")
+
+// SetupWebhookWithManager registers webhooks enforcing deletion protection of Horreum
+// resources and of the persistent volume claims used by their database.
+func (r *Horreum) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	mgr.GetWebhookServer().Register("/validate-v1-persistentvolumeclaim", &webhook.Admission{
+		Handler: &persistentVolumeClaimValidator{reader: mgr.GetAPIReader()},
+	})
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/validate-hyperfoil-io-v1alpha1-horreum,mutating=false,failurePolicy=fail,sideEffects=None,groups=hyperfoil.io,resources=horreums,verbs=delete,versions=v1alpha1,name=vhorreum.hyperfoil.io,admissionReviewVersions=v1
+
+var _ webhook.Validator = &Horreum{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *Horreum) ValidateCreate() error {
+	return nil
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *Horreum) ValidateUpdate(old runtime.Object) error {
+	return nil
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *Horreum) ValidateDelete() error {
+	if r.Spec.DeletionProtection {
+		horreumlog.Info("Rejected deletion of protected resource", "namespace", r.Namespace, "name", r.Name)
+		return fmt.Errorf("Horreum %s has deletion protection enabled; set spec.deletionProtection to false first", r.Name)
+	}
+	return nil
+}
+
+// config/webhook adds an objectSelector on the `app` label, so only labelled claims are sent to the operator;
+// deletion of these claims fails while the operator is not available.
+//+kubebuilder:webhook:path=/validate-v1-persistentvolumeclaim,mutating=false,failurePolicy=fail,sideEffects=None,groups="",resources=persistentvolumeclaims,verbs=delete,versions=v1,name=vpersistentvolumeclaim.hyperfoil.io,admissionReviewVersions=v1
+
+// persistentVolumeClaimValidator rejects deletion of claims used by a protected Horreum resource
+// +kubebuilder:object:generate=false
+type persistentVolumeClaimValidator struct {
+	// Uncached reader, the manager cache may be limited to watched namespaces
+	reader client.Reader
+}
+
+func (v *persistentVolumeClaimValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	list := &HorreumList{}
+	if err := v.reader.List(ctx, list, client.InNamespace(req.Namespace)); errors.IsForbidden(err) {
+		// The operator is not permitted to manage Horreum resources in this namespace
+		return admission.Allowed("")
+	} else if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	for _, horreum := range list.Items {
+		if horreum.Spec.DeletionProtection && horreum.Spec.Postgres.PersistentVolumeClaim == req.Name {
+			horreumlog.Info("Rejected deletion of protected persistent volume claim", "namespace", req.Namespace, "name", req.Name)
+			return admission.Denied(fmt.Sprintf("persistent volume claim %s is used by Horreum %s with deletion protection enabled", req.Name, horreum.Name))
+		}
+	}
+	return admission.Allowed("")
+}
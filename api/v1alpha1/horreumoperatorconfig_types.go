@@ -0,0 +1,97 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// OperatorConfigName is the name of the only HorreumOperatorConfig resource the operator reads
+const OperatorConfigName = "cluster"
+
+// DefaultImagesSpec defines images used when Horreum resource does not set them
+type DefaultImagesSpec struct {
+	// Repository of Horreum application image; the tag is selected by `version`. Defaults to quay.io/hyperfoil/horreum
+	App string `json:"app,omitempty"`
+	// Repository of Keycloak image; the tag is selected by `version`. Defaults to quay.io/hyperfoil/horreum-keycloak
+	Keycloak string `json:"keycloak,omitempty"`
+	// Image used for PostgreSQL deployment. Defaults to the image of the selected profile.
+	Postgres string `json:"postgres,omitempty"`
+	// Profile of PostgreSQL image, see `postgres.imageProfile` in Horreum resource
+	// +kubebuilder:validation:Enum=upstream;redhat;bitnami
+	PostgresProfile string `json:"postgresProfile,omitempty"`
+}
+
+// DefaultResourcesSpec defines compute resources used when Horreum resource does not set them
+type DefaultResourcesSpec struct {
+	// Compute resources of Horreum application containers
+	App corev1.ResourceRequirements `json:"app,omitempty"`
+	// Compute resources of Keycloak container
+	Keycloak corev1.ResourceRequirements `json:"keycloak,omitempty"`
+	// Compute resources of PostgreSQL containers
+	Postgres corev1.ResourceRequirements `json:"postgres,omitempty"`
+}
+
+// PlatformSpec overrides detection of the platform
+type PlatformSpec struct {
+	// False to expose services without OpenShift routes (NodePort by default) even when the route API is available.
+	// Routes cannot be enabled when the API is not available.
+	Routes *bool `json:"routes,omitempty"`
+}
+
+// HorreumOperatorConfigSpec defines cluster-wide defaults of the operator
+type HorreumOperatorConfigSpec struct {
+	// Default images
+	Images DefaultImagesSpec `json:"images,omitempty"`
+	// Default compute resources
+	Resources DefaultResourcesSpec `json:"resources,omitempty"`
+	// Namespaces where Horreum resources are reconciled; resources in other namespaces are ignored.
+	// All namespaces are reconciled when empty.
+	WatchNamespaces []string `json:"watchNamespaces,omitempty"`
+	// Overrides of platform detection
+	Platform PlatformSpec `json:"platform,omitempty"`
+	// Provider of service certificates: `operator` generates own CA, `service-ca` uses OpenShift service CA operator.
+	// Defaults to `service-ca` on OpenShift and `operator` elsewhere.
+	// +kubebuilder:validation:Enum=operator;service-ca
+	CertificateProvider string `json:"certificateProvider,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// HorreumOperatorConfig holds cluster-wide defaults for all Horreum resources; only the resource named `cluster` is used
+// +kubebuilder:resource:path=horreumoperatorconfigs,scope=Cluster
+// +kubebuilder:categories=hyperfoil
+type HorreumOperatorConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec HorreumOperatorConfigSpec `json:"spec,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// HorreumOperatorConfigList contains a list of HorreumOperatorConfig
+type HorreumOperatorConfigList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []HorreumOperatorConfig `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&HorreumOperatorConfig{}, &HorreumOperatorConfigList{})
+}
@@ -1,42 +1,48 @@
 package horreum
 
 import (
+	"regexp"
+	"sort"
+	"strings"
+
 	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
 	routev1 "github.com/openshift/api/route/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-func appPod(cr *hyperfoilv1alpha1.Horreum, keycloakPublicUrl, appPublicUrl string) *corev1.Pod {
+func appPod(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler, keycloakPublicUrl, appPublicUrl string) *corev1.Pod {
 	keycloakInternalURL := keycloakInternalURL(cr)
 
 	horreumEnv := []corev1.EnvVar{
 		{
 			Name:  "QUARKUS_DATASOURCE_JDBC_URL",
-			Value: dbURL(cr, &cr.Spec.Database, "horreum"),
+			Value: dbURL(cr, &cr.Spec.Database, databaseName(cr)) + dbURLProperties(&cr.Spec.Database, "/etc/ssl/certs/trusted-ca"),
 		},
-		secretEnv("QUARKUS_DATASOURCE_USERNAME", appUserSecret(cr), corev1.BasicAuthUsernameKey),
+		dbUserEnv(cr, "QUARKUS_DATASOURCE_USERNAME", appUserSecret(cr)),
 		secretEnv("QUARKUS_DATASOURCE_PASSWORD", appUserSecret(cr), corev1.BasicAuthPasswordKey),
 		{
 			Name:  "QUARKUS_DATASOURCE_MIGRATION_JDBC_URL",
-			Value: dbURL(cr, &cr.Spec.Database, "horreum"),
+			Value: dbURL(cr, &cr.Spec.Database, databaseName(cr)) + dbURLProperties(&cr.Spec.Database, "/etc/ssl/certs/trusted-ca"),
 		},
-		secretEnv("QUARKUS_DATASOURCE_MIGRATION_USERNAME", dbAdminSecret(cr), corev1.BasicAuthUsernameKey),
+		dbUserEnv(cr, "QUARKUS_DATASOURCE_MIGRATION_USERNAME", dbAdminSecret(cr)),
 		secretEnv("QUARKUS_DATASOURCE_MIGRATION_PASSWORD", dbAdminSecret(cr), corev1.BasicAuthPasswordKey),
 		secretEnv("HORREUM_DB_SECRET", appUserSecret(cr), "dbsecret"),
 		{
 			Name:  "QUARKUS_OIDC_AUTH_SERVER_URL",
-			Value: keycloakInternalURL + "/realms/horreum",
+			Value: keycloakInternalURL + "/realms/" + keycloakRealm(cr),
 		},
 		{
 			Name:  "QUARKUS_OIDC_TOKEN_ISSUER",
-			Value: keycloakPublicUrl + "/realms/horreum",
+			Value: keycloakPublicUrl + "/realms/" + keycloakRealm(cr),
 		},
 		{
-			// TODO: it's not possible to set up custom CA for OIDC
-			// https://github.com/quarkusio/quarkus/issues/18002
+			// It's not possible to set up custom CA for OIDC (https://github.com/quarkusio/quarkus/issues/18002)
+			// so we can verify the certificates only when the trusted CAs are imported into JVM truststore.
 			Name:  "QUARKUS_OIDC_TLS_VERIFICATION",
-			Value: "none",
+			Value: withDefault(cr.Spec.Keycloak.TLSVerification, "none"),
 		},
 		{
 			Name:  "HORREUM_URL",
@@ -51,6 +57,18 @@ func appPod(cr *hyperfoilv1alpha1.Horreum, keycloakPublicUrl, appPublicUrl strin
 			Value: keycloakPublicUrl + "/",
 		},
 	}
+	// Realm in shared Keycloak is provisioned by the operator rather than by the setup script
+	clientSecretImport := `
+							export QUARKUS_OIDC_CREDENTIALS_SECRET=$$(cat /etc/horreum/imports/clientsecret)`
+	if cr.Spec.Keycloak.Shared != nil {
+		clientSecretImport = ""
+		horreumEnv = append(horreumEnv,
+			secretEnv("QUARKUS_OIDC_CREDENTIALS_SECRET", keycloakClientSecret(cr), keycloakClientSecretKey),
+			corev1.EnvVar{
+				Name:  "HORREUM_KEYCLOAK_REALM",
+				Value: keycloakRealm(cr),
+			})
+	}
 	if javaOptions, ok := cr.ObjectMeta.Annotations["java-options"]; ok {
 		horreumEnv = append(horreumEnv, corev1.EnvVar{
 			Name:  "JAVA_OPTIONS",
@@ -111,11 +129,60 @@ func appPod(cr *hyperfoilv1alpha1.Horreum, keycloakPublicUrl, appPublicUrl strin
 			Value: "/opt/certs/" + corev1.TLSPrivateKeyKey,
 		})
 	}
+	initMounts := []corev1.VolumeMount{
+		{
+			Name:      "imports",
+			MountPath: "/etc/horreum/imports",
+		},
+		{
+			Name:      "service-ca",
+			MountPath: "/etc/ssl/certs/service-ca.crt",
+			SubPath:   "service-ca.crt",
+		},
+	}
 	caCertArg := ""
-	if routeType == "reencrypt" || routeType == "" {
+	if cr.Spec.Keycloak.External.PublicUri != "" && cr.Spec.TrustedCABundle != "" {
+		caCertArg = "--cacert /etc/ssl/certs/trusted-ca/" + trustedCABundleKey
+	} else if routeType == "reencrypt" || routeType == "" {
 		caCertArg = "--cacert /etc/ssl/certs/service-ca.crt"
 	}
-	return &corev1.Pod{
+	probePort, probeScheme := int32(8443), corev1.URISchemeHTTPS
+	if innerProtocol(cr.Spec.Route) == "http://" {
+		probePort, probeScheme = 8080, corev1.URISchemeHTTP
+	}
+	if len(cr.Spec.Config) > 0 {
+		volumes = append(volumes, corev1.Volume{
+			Name: "config",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: cr.Name + "-app-config",
+					},
+				},
+			},
+		})
+		mounts = append(mounts, corev1.VolumeMount{
+			Name:      "config",
+			MountPath: "/etc/horreum/config",
+		})
+		horreumEnv = append(horreumEnv, corev1.EnvVar{
+			Name:  "QUARKUS_CONFIG_LOCATIONS",
+			Value: "/etc/horreum/config/application.properties",
+		})
+	}
+	horreumEnv = append(horreumEnv, appTracingEnv(cr)...)
+	trustedCAImport := ""
+	if cr.Spec.TrustedCABundle != "" {
+		volumes = append(volumes, trustedCAVolume(cr))
+		mounts = append(mounts, trustedCAMount("/etc/ssl/certs/trusted-ca"))
+		initMounts = append(initMounts, trustedCAMount("/etc/ssl/certs/trusted-ca"))
+		// keytool imports only the first certificate from a file, therefore we need to split the bundle;
+		// comments preceding the first certificate are dropped
+		trustedCAImport = `
+							awk '/BEGIN CERTIFICATE/ { n++ } n { print > "/tmp/trusted-ca-" n ".crt" }' /etc/ssl/certs/trusted-ca/` + trustedCABundleKey + `
+							for f in /tmp/trusted-ca-*.crt; do keytool -noprompt -import -alias $$(basename $$f .crt) -file $$f -cacerts -storepass changeit; done`
+	}
+	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      cr.Name + "-app",
 			Namespace: cr.Namespace,
@@ -128,9 +195,8 @@ func appPod(cr *hyperfoilv1alpha1.Horreum, keycloakPublicUrl, appPublicUrl strin
 			TerminationGracePeriodSeconds: &[]int64{0}[0],
 			InitContainers: []corev1.Container{
 				{
-					Name:            "init",
-					Image:           appImage(cr),
-					ImagePullPolicy: corev1.PullAlways,
+					Name:  "init",
+					Image: r.mirrorImage(appImage(cr, r)),
 					Command: []string{
 						"sh", "-x", "-c", "/deployments/k8s-setup.sh",
 					},
@@ -152,37 +218,180 @@ func appPod(cr *hyperfoilv1alpha1.Horreum, keycloakPublicUrl, appPublicUrl strin
 							Value: appPublicUrl,
 						},
 					},
-					VolumeMounts: []corev1.VolumeMount{
-						{
-							Name:      "imports",
-							MountPath: "/etc/horreum/imports",
-						},
-						{
-							Name:      "service-ca",
-							MountPath: "/etc/ssl/certs/service-ca.crt",
-							SubPath:   "service-ca.crt",
-						},
-					},
+					VolumeMounts: initMounts,
+					Resources:    withDefaultResources(cr.Spec.Resources, r.operatorConfig().Resources.App),
 				},
 			},
 			Containers: []corev1.Container{
 				{
 					Name:  "horreum",
-					Image: appImage(cr),
+					Image: r.mirrorImage(appImage(cr, r)),
 					Command: []string{
 						"sh", "-c", `
-							keytool -noprompt -import -alias service-ca -file /etc/ssl/certs/service-ca.crt -cacerts -storepass changeit
-							export QUARKUS_OIDC_CREDENTIALS_SECRET=$$(cat /etc/horreum/imports/clientsecret)
+							keytool -noprompt -import -alias service-ca -file /etc/ssl/certs/service-ca.crt -cacerts -storepass changeit` +
+							trustedCAImport + clientSecretImport + `
 							/deployments/horreum.sh
 						`,
 					},
 					Env:          horreumEnv,
 					VolumeMounts: mounts,
+					Resources:    withDefaultResources(cr.Spec.Resources, r.operatorConfig().Resources.App),
+					// Database migration may take a while on the first start
+					StartupProbe:   withDefaultProbe(cr.Spec.Probes.Startup, httpProbe("/q/health/started", probePort, probeScheme, 5, 120)),
+					LivenessProbe:  withDefaultProbe(cr.Spec.Probes.Liveness, httpProbe("/q/health/live", probePort, probeScheme, 10, 3)),
+					ReadinessProbe: withDefaultProbe(cr.Spec.Probes.Readiness, httpProbe("/q/health/ready", probePort, probeScheme, 10, 3)),
 				},
 			},
 			Volumes: volumes,
 		},
 	}
+	if cr.Spec.Keycloak.Shared != nil {
+		pod.Spec.InitContainers = nil
+	}
+	applyScheduling(&pod.Spec, &cr.Spec.SchedulingSpec)
+	applyCustomization(pod, &cr.Spec.PodCustomizationSpec)
+	return pod
+}
+
+func appProperties(cr *hyperfoilv1alpha1.Horreum) string {
+	keys := make([]string, 0, len(cr.Spec.Config))
+	for key := range cr.Spec.Config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for _, key := range keys {
+		sb.WriteString(escapePropertiesKey(key) + "=" + escapePropertiesValue(cr.Spec.Config[key]) + "\n")
+	}
+	return sb.String()
+}
+
+// Escaping follows java.util.Properties.store: separators, comment characters and whitespace are significant in keys
+var propertiesKeyEscape = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r", "\t", "\\t", "\f", "\\f",
+	" ", "\\ ", "=", "\\=", ":", "\\:", "#", "\\#", "!", "\\!")
+
+var propertiesValueEscape = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r", "\t", "\\t", "\f", "\\f")
+
+func escapePropertiesKey(key string) string {
+	return propertiesKeyEscape.Replace(key)
+}
+
+// escapePropertiesValue escapes leading space which would be otherwise trimmed when the value is loaded
+func escapePropertiesValue(value string) string {
+	escaped := propertiesValueEscape.Replace(value)
+	if strings.HasPrefix(escaped, " ") {
+		return "\\" + escaped
+	}
+	return escaped
+}
+
+func appConfigMap(cr *hyperfoilv1alpha1.Horreum) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.Name + "-app-config",
+			Namespace: cr.Namespace,
+			Labels: map[string]string{
+				"app": cr.Name,
+			},
+		},
+		Data: map[string]string{
+			"application.properties": appProperties(cr),
+		},
+	}
+}
+
+var nonAlphanumeric = regexp.MustCompile("[^A-Z0-9]")
+
+// configConflicts returns properties from spec.config that would be overridden by environment variables
+// of the application container (Quarkus gives environment variables higher priority).
+func configConflicts(cr *hyperfoilv1alpha1.Horreum, pod *corev1.Pod) []string {
+	conflicts := []string{}
+	for key := range cr.Spec.Config {
+		envName := nonAlphanumeric.ReplaceAllString(strings.ToUpper(key), "_")
+		if hasEnv(pod.Spec.Containers[0].Env, envName) {
+			conflicts = append(conflicts, key)
+		}
+	}
+	sort.Strings(conflicts)
+	return conflicts
+}
+
+func appDeployment(cr *hyperfoilv1alpha1.Horreum, pod *corev1.Pod) *appsv1.Deployment {
+	var replicas *int32
+	if appScaledDown(cr) {
+		replicas = &[]int32{0}[0]
+	} else if appMigrating(cr) {
+		replicas = &[]int32{1}[0]
+	} else if cr.Spec.Autoscaling == nil {
+		replicas = &[]int32{1}[0]
+		if cr.Spec.Replicas != nil {
+			replicas = cr.Spec.Replicas
+		}
+	}
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.Name + "-app",
+			Namespace: cr.Namespace,
+			Labels: map[string]string{
+				"app":     cr.Name,
+				"service": "app",
+			},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app":     cr.Name,
+					"service": "app",
+				},
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      pod.Labels,
+					Annotations: pod.Annotations,
+				},
+				Spec: pod.Spec,
+			},
+		},
+	}
+}
+
+func appAutoscaler(cr *hyperfoilv1alpha1.Horreum) *autoscalingv2.HorizontalPodAutoscaler {
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.Name + "-app",
+			Namespace: cr.Namespace,
+		},
+	}
+	if cr.Spec.Autoscaling == nil {
+		return hpa
+	}
+	targetCPU := int32(80)
+	if cr.Spec.Autoscaling.TargetCPUUtilizationPercentage != nil {
+		targetCPU = *cr.Spec.Autoscaling.TargetCPUUtilizationPercentage
+	}
+	hpa.Spec = autoscalingv2.HorizontalPodAutoscalerSpec{
+		ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{
+			APIVersion: "apps/v1",
+			Kind:       "Deployment",
+			Name:       cr.Name + "-app",
+		},
+		MinReplicas: cr.Spec.Autoscaling.MinReplicas,
+		MaxReplicas: cr.Spec.Autoscaling.MaxReplicas,
+		Metrics: []autoscalingv2.MetricSpec{
+			{
+				Type: autoscalingv2.ResourceMetricSourceType,
+				Resource: &autoscalingv2.ResourceMetricSource{
+					Name: corev1.ResourceCPU,
+					Target: autoscalingv2.MetricTarget{
+						Type:               autoscalingv2.UtilizationMetricType,
+						AverageUtilization: &targetCPU,
+					},
+				},
+			},
+		},
+	}
+	return hpa
 }
 
 func appService(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) *corev1.Service {
@@ -190,6 +399,10 @@ func appService(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) *corev1.Ser
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      cr.Name,
 			Namespace: cr.Namespace,
+			Labels: map[string]string{
+				"app":     cr.Name,
+				"service": "app",
+			},
 			Annotations: map[string]string{
 				"service.beta.openshift.io/serving-cert-secret-name": cr.Name + "-app-certs",
 			},
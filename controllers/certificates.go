@@ -115,6 +115,8 @@ func createCA(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler, logger logr.L
 		}
 	}
 
+	recordCertificateExpiry(cr, caSecret.Name, caPEMBytes)
+
 	serviceCaConfigMap := &corev1.ConfigMap{}
 	err = r.Get(context.TODO(), types.NamespacedName{Name: "service-ca.crt", Namespace: cr.Namespace}, serviceCaConfigMap)
 	if err != nil && errors.IsNotFound(err) {
@@ -219,10 +221,13 @@ func createServiceCert(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler, logg
 		err = r.Create(context.TODO(), certSecret)
 		if err != nil {
 			logger.Error(err, "Cannot create secret with service certificate")
+		} else {
+			recordCertificateExpiry(cr, resourceName, certPEM.Bytes())
 		}
 		return err
 	} else if err == nil {
 		logger.Info("Certificate " + resourceName + " is present, not doing anything")
+		recordCertificateExpiry(cr, resourceName, certSecret.Data[corev1.TLSCertKey])
 		return nil
 	} else {
 		return err
@@ -5,12 +5,42 @@ import (
 )
 
 func dbDefaultHost(cr *hyperfoilv1alpha1.Horreum) string {
+	if shared := cr.Spec.Postgres.Shared; shared != nil {
+		if shared.Horreum == "" {
+			return shared.Host
+		}
+		provider := sharedPostgresProviderName(cr)
+		return provider.Name + "-db." + provider.Namespace + ".svc"
+	}
 	return cr.Name + "-db." + cr.Namespace + ".svc"
 }
 
+func dbDefaultPort(cr *hyperfoilv1alpha1.Horreum) int32 {
+	if shared := cr.Spec.Postgres.Shared; shared != nil && shared.Horreum == "" && shared.Port != 0 {
+		return shared.Port
+	}
+	return 5432
+}
+
 func dbURL(cr *hyperfoilv1alpha1.Horreum, db *hyperfoilv1alpha1.DatabaseSpec, defName string) string {
 	return "jdbc:postgresql://" + withDefault(db.Host, dbDefaultHost(cr)) +
-		":" + withDefaultInt(db.Port, 5432) + "/" + withDefault(db.Name, defName)
+		":" + withDefaultInt(db.Port, dbDefaultPort(cr)) + "/" + withDefault(db.Name, defName)
+}
+
+// dbURLProperties returns query of the JDBC URL setting sslmode; certDir is where the trusted CA bundle is mounted
+func dbURLProperties(db *hyperfoilv1alpha1.DatabaseSpec, certDir string) string {
+	switch db.SSLMode {
+	case "":
+		return ""
+	case "verify-ca", "verify-full":
+		// pgjdbc does not use the JVM truststore
+		return "?sslmode=" + db.SSLMode + "&sslrootcert=" + certDir + "/" + trustedCABundleKey
+	}
+	return "?sslmode=" + db.SSLMode
+}
+
+func verifiesDatabase(db *hyperfoilv1alpha1.DatabaseSpec) bool {
+	return db.SSLMode == "verify-ca" || db.SSLMode == "verify-full"
 }
 
 func dbAdminSecret(cr *hyperfoilv1alpha1.Horreum) string {
@@ -33,13 +63,20 @@ func horreumAdminSecret(cr *hyperfoilv1alpha1.Horreum) string {
 	return withDefault(cr.Spec.AdminSecret, cr.Name+"-admin")
 }
 
-func dbImage(cr *hyperfoilv1alpha1.Horreum, useRedHatImage bool) string {
-	return withDefault(cr.Spec.Postgres.Image,
-		ifThenElse(useRedHatImage, "registry.redhat.io/rhel8/postgresql-12:latest", "docker.io/library/postgres:14.4"))
+func appImage(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) string {
+	if cr.Spec.Image != "" {
+		return cr.Spec.Image
+	}
+	repository := withDefault(r.operatorConfig().Images.App, "quay.io/hyperfoil/horreum")
+	return versionedImage(cr, repository, cr.Status.Current.AppImage, upgradePhaseApp)
 }
 
-func appImage(cr *hyperfoilv1alpha1.Horreum) string {
-	return withDefault(cr.Spec.Image, "quay.io/hyperfoil/horreum:latest")
+func keycloakImage(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) string {
+	if cr.Spec.Keycloak.Image != "" {
+		return cr.Spec.Keycloak.Image
+	}
+	repository := withDefault(r.operatorConfig().Images.Keycloak, "quay.io/hyperfoil/horreum-keycloak")
+	return versionedImage(cr, repository, cr.Status.Current.KeycloakImage, upgradePhaseKeycloak)
 }
 
 func keycloakInternalURL(cr *hyperfoilv1alpha1.Horreum) string {
@@ -49,5 +86,9 @@ func keycloakInternalURL(cr *hyperfoilv1alpha1.Horreum) string {
 	if cr.Spec.Keycloak.External.PublicUri != "" {
 		return cr.Spec.Keycloak.External.PublicUri
 	}
+	if cr.Spec.Keycloak.Shared != nil {
+		provider := sharedKeycloakProviderName(cr)
+		return "https://" + provider.Name + "-keycloak." + provider.Namespace + ".svc"
+	}
 	return "https://" + cr.Name + "-keycloak." + cr.Namespace + ".svc"
 }
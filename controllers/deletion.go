@@ -0,0 +1,307 @@
+package horreum
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	logr "github.com/go-logr/logr"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	deletionPolicyDelete   = "Delete"
+	deletionPolicyRetain   = "Retain"
+	deletionPolicySnapshot = "Snapshot"
+
+	deletionPolicyFinalizer = "hyperfoil.io/deletion-policy"
+	retainedFromAnnotation  = "hyperfoil.io/retained-from"
+
+	conditionDeletionProtected = "DeletionProtected"
+	// Name of the webhook rejecting deletion of protected Horreum resources
+	deletionProtectionWebhook = "vhorreum.hyperfoil.io"
+)
+
+var volumeSnapshotKind = schema.GroupVersionKind{Group: "snapshot.storage.k8s.io", Version: "v1", Kind: "VolumeSnapshot"}
+
+// ensureFinalizer adds the finalizer when the deletion policy requires action before the resource is removed,
+// or when there is a realm or database to be removed from shared Keycloak or PostgreSQL
+func ensureFinalizer(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum) error {
+	needed := withDefault(cr.Spec.DeletionPolicy, deletionPolicyDelete) != deletionPolicyDelete ||
+		cr.Spec.Keycloak.Shared != nil || cr.Status.SharedKeycloak != nil || cr.Spec.Postgres.Shared != nil ||
+		cr.Status.SharedDatabaseProvisioned
+	if needed == controllerutil.ContainsFinalizer(cr, deletionPolicyFinalizer) {
+		return nil
+	}
+	if needed {
+		controllerutil.AddFinalizer(cr, deletionPolicyFinalizer)
+	} else {
+		controllerutil.RemoveFinalizer(cr, deletionPolicyFinalizer)
+	}
+	return r.Update(context.TODO(), cr)
+}
+
+// checkDeletionProtection reports in condition DeletionProtected whether the webhook enforcing
+// spec.deletionProtection is installed; without the webhook the flag has no effect.
+func checkDeletionProtection(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum) {
+	if !cr.Spec.DeletionProtection {
+		meta.RemoveStatusCondition(&cr.Status.Conditions, conditionDeletionProtected)
+		return
+	}
+	condition := metav1.Condition{
+		Type:               conditionDeletionProtected,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: cr.Generation,
+		Reason:             "WebhookInstalled",
+		Message:            "Deletion is rejected by webhook " + deletionProtectionWebhook,
+	}
+	list := &admissionregistrationv1.ValidatingWebhookConfigurationList{}
+	if err := r.clusterReader().List(context.TODO(), list); err != nil {
+		r.logClusterReadError(err, "ValidatingWebhookConfigurations")
+		condition.Status = metav1.ConditionUnknown
+		condition.Reason = "CannotVerify"
+		condition.Message = "Cannot verify that webhook " + deletionProtectionWebhook + " is installed"
+	} else if !hasWebhook(list, deletionProtectionWebhook) {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "WebhookMissing"
+		condition.Message = "Webhook " + deletionProtectionWebhook + " is not installed, spec.deletionProtection has no effect"
+		if !meta.IsStatusConditionFalse(cr.Status.Conditions, conditionDeletionProtected) {
+			recordEvent(r, cr, corev1.EventTypeWarning, "DeletionNotProtected", condition.Message)
+		}
+	}
+	meta.SetStatusCondition(&cr.Status.Conditions, condition)
+}
+
+func hasWebhook(list *admissionregistrationv1.ValidatingWebhookConfigurationList, name string) bool {
+	for _, configuration := range list.Items {
+		for _, webhook := range configuration.Webhooks {
+			if webhook.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// finalize applies the deletion policy; owned objects not kept are garbage-collected after the finalizer is removed
+func finalize(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger) (reconcile.Result, error) {
+	if !controllerutil.ContainsFinalizer(cr, deletionPolicyFinalizer) {
+		return reconcile.Result{}, nil
+	}
+	secrets, err := ownedSecrets(r, cr)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	switch withDefault(cr.Spec.DeletionPolicy, deletionPolicyDelete) {
+	case deletionPolicyDelete:
+		if err := deleteSharedRealm(r, cr, logger); err != nil {
+			return reconcile.Result{}, err
+		}
+		if done, err := dropSharedDatabase(r, cr, logger); err != nil {
+			return reconcile.Result{}, err
+		} else if !done {
+			return sharedDatabaseRequeue(cr), nil
+		}
+	case deletionPolicyRetain:
+		for i := range secrets {
+			if err := orphan(r, cr, &secrets[i]); err != nil {
+				return reconcile.Result{}, err
+			}
+			logger.Info("Retaining secret " + secrets[i].Name)
+		}
+		if pvc, err := databasePVC(r, cr); err != nil {
+			return reconcile.Result{}, err
+		} else if pvc != nil {
+			if err := orphan(r, cr, pvc); err != nil {
+				return reconcile.Result{}, err
+			}
+			logger.Info("Retaining persistent volume claim " + pvc.Name)
+		}
+	case deletionPolicySnapshot:
+		// Names derived from deletion timestamp keep the backup idempotent when finalization is retried
+		suffix := strconv.FormatInt(cr.DeletionTimestamp.Unix(), 10)
+		if err := backupSecrets(r, cr, secrets, cr.Name+"-backup-"+suffix); err != nil {
+			return reconcile.Result{}, err
+		}
+		if cr.Spec.Postgres.PersistentVolumeClaim != "" {
+			retain := !r.SnapshotsAvailable
+			if r.SnapshotsAvailable {
+				name := cr.Name + "-db-" + suffix
+				if err := snapshotVolume(r, cr, cr.Spec.Postgres.PersistentVolumeClaim, name); err != nil {
+					return reconcile.Result{}, err
+				}
+				// The volume must not be deleted before the snapshot is taken
+				ready, failure, err := snapshotReady(r, cr, name)
+				if err != nil {
+					return reconcile.Result{}, err
+				} else if failure != "" {
+					recordEvent(r, cr, corev1.EventTypeWarning, "SnapshotFailed", "VolumeSnapshot "+name+" failed: "+failure)
+					retain = true
+				} else if !ready {
+					logger.Info("Waiting for VolumeSnapshot " + name + " to be ready")
+					return reconcile.Result{RequeueAfter: 10 * time.Second}, nil
+				}
+			}
+			if retain {
+				if pvc, err := databasePVC(r, cr); err != nil {
+					return reconcile.Result{}, err
+				} else if pvc != nil {
+					// Without snapshot the only way to keep the data is not to delete the volume
+					recordEvent(r, cr, corev1.EventTypeWarning, "SnapshotUnavailable",
+						"Volume snapshot is not available, retaining persistent volume claim "+pvc.Name)
+					if err := orphan(r, cr, pvc); err != nil {
+						return reconcile.Result{}, err
+					}
+				}
+			}
+		}
+		lastBackup.WithLabelValues(cr.Namespace, cr.Name).SetToCurrentTime()
+	}
+	if err := deleteSharedDatabaseObjects(r, cr); err != nil {
+		return reconcile.Result{}, err
+	}
+	controllerutil.RemoveFinalizer(cr, deletionPolicyFinalizer)
+	return reconcile.Result{}, r.Update(context.TODO(), cr)
+}
+
+func ownedSecrets(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum) ([]corev1.Secret, error) {
+	list := &corev1.SecretList{}
+	if err := r.List(context.TODO(), list, client.InNamespace(cr.Namespace)); err != nil {
+		return nil, err
+	}
+	secrets := []corev1.Secret{}
+	for _, secret := range list.Items {
+		if metav1.IsControlledBy(&secret, cr) {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets, nil
+}
+
+// databasePVC returns the claim used by the database, or nil if there's none
+func databasePVC(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum) (*corev1.PersistentVolumeClaim, error) {
+	if cr.Spec.Postgres.PersistentVolumeClaim == "" {
+		return nil, nil
+	}
+	pvc := &corev1.PersistentVolumeClaim{}
+	err := r.Get(context.TODO(), types.NamespacedName{Name: cr.Spec.Postgres.PersistentVolumeClaim, Namespace: cr.Namespace}, pvc)
+	if err != nil && errors.IsNotFound(err) {
+		return nil, nil
+	}
+	return pvc, err
+}
+
+// labelProtectedPVC adds the `app` label to the database claim of a protected resource: the deletion webhook
+// receives only requests for claims with this label so that it does not intercept every claim in the cluster
+func labelProtectedPVC(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum) error {
+	if !cr.Spec.DeletionProtection {
+		return nil
+	}
+	pvc, err := databasePVC(r, cr)
+	if err != nil || pvc == nil {
+		return err
+	}
+	if _, ok := pvc.Labels["app"]; ok {
+		return nil
+	}
+	if pvc.Labels == nil {
+		pvc.Labels = map[string]string{}
+	}
+	pvc.Labels["app"] = cr.Name
+	return r.Update(context.TODO(), pvc)
+}
+
+// orphan removes owner references to the Horreum resource so that the object is not garbage-collected
+func orphan(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, object client.Object) error {
+	references := []metav1.OwnerReference{}
+	for _, ref := range object.GetOwnerReferences() {
+		if ref.UID != cr.UID {
+			references = append(references, ref)
+		}
+	}
+	if len(references) == len(object.GetOwnerReferences()) {
+		return nil
+	}
+	object.SetOwnerReferences(references)
+	annotations := object.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[retainedFromAnnotation] = cr.Name
+	object.SetAnnotations(annotations)
+	return r.Update(context.TODO(), object)
+}
+
+// backupSecrets copies all secrets into a single secret with keys `<secret name>.<key>`
+func backupSecrets(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, secrets []corev1.Secret, name string) error {
+	backup := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cr.Namespace,
+			Labels: map[string]string{
+				"app": cr.Name,
+			},
+			Annotations: map[string]string{
+				retainedFromAnnotation: cr.Name,
+			},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{},
+	}
+	for _, secret := range secrets {
+		for key, value := range secret.Data {
+			backup.Data[secret.Name+"."+key] = value
+		}
+	}
+	if err := r.Create(context.TODO(), backup); err != nil && !errors.IsAlreadyExists(err) {
+		return err
+	}
+	recordEvent(r, cr, corev1.EventTypeNormal, "BackedUp", "Copied "+strconv.Itoa(len(secrets))+" secrets to "+name)
+	return nil
+}
+
+func snapshotVolume(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, pvc string, name string) error {
+	snapshot := newUnstructured(volumeSnapshotKind)
+	snapshot.SetName(name)
+	snapshot.SetNamespace(cr.Namespace)
+	snapshot.SetLabels(map[string]string{
+		"app": cr.Name,
+	})
+	snapshot.Object["spec"] = map[string]interface{}{
+		"source": map[string]interface{}{
+			"persistentVolumeClaimName": pvc,
+		},
+	}
+	if err := r.Create(context.TODO(), snapshot); err != nil {
+		if errors.IsAlreadyExists(err) {
+			return nil
+		}
+		return err
+	}
+	recordEvent(r, cr, corev1.EventTypeNormal, "BackedUp", "Created VolumeSnapshot "+name+" of "+pvc)
+	return nil
+}
+
+// snapshotReady returns true when the snapshot can be used to restore the volume, or error message reported by the snapshotter
+func snapshotReady(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, name string) (bool, string, error) {
+	snapshot := newUnstructured(volumeSnapshotKind)
+	if err := r.uncachedReader().Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, snapshot); err != nil {
+		return false, "", err
+	}
+	if message, found, _ := unstructured.NestedString(snapshot.Object, "status", "error", "message"); found {
+		return false, message, nil
+	}
+	ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse")
+	return ready, "", nil
+}
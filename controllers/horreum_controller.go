@@ -21,11 +21,16 @@ import (
 	stdErrors "errors"
 	"fmt"
 	"reflect"
+	"strings"
 
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
 	"github.com/google/go-cmp/cmp"
@@ -33,21 +38,49 @@ import (
 	logr "github.com/go-logr/logr"
 
 	routev1 "github.com/openshift/api/route/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 )
 
 // HorreumReconciler reconciles a Horreum object
 type HorreumReconciler struct {
 	client.Client
+	// Reader bypassing the cache, used where just created objects must be visible
+	APIReader       client.Reader
 	Log             logr.Logger
+	Recorder        record.EventRecorder
 	Scheme          *runtime.Scheme
 	RoutesAvailable bool
-	UseRedHatImages bool
+	// True when Prometheus Operator (monitoring.coreos.com) API is available
+	MonitoringAvailable bool
+	// True when VolumeSnapshot (snapshot.storage.k8s.io) API is available
+	SnapshotsAvailable bool
+	// Registry rewrite table applied to all images
+	ImageMirrors []ImageMirror
+	// True when OpenShift ImageContentSourcePolicy (operator.openshift.io) API is available
+	MirrorPoliciesAvailable bool
+	// True when running on OpenShift; selects Red Hat database images and avoids containers running as root
+	OpenShift bool
+	// Database image profile used when neither spec.postgres.imageProfile nor a recognized image is set
+	DefaultImageProfile string
+	// Namespaces the manager cache is limited to; all namespaces when empty. The operator might not have
+	// permissions to read cluster-scoped resources in this case.
+	WatchNamespaces []string
+	// Namespace where the operator runs (from downward API); empty when running outside of the cluster
+	OperatorNamespace string
+	// Operator configuration and ImageContentSourcePolicy mirrors read once per reconciliation, see forReconcile
+	config        *hyperfoilv1alpha1.HorreumOperatorConfigSpec
+	policyMirrors []ImageMirror
 }
 
 type compareFunc func(interface{}, interface{}, logr.Logger) bool
@@ -63,9 +96,17 @@ var nocheck = func(interface{}) (bool, string, string) {
 //+kubebuilder:rbac:groups=hyperfoil.io,resources=horreums,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=hyperfoil.io,resources=horreums/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=hyperfoil.io,resources=horreums/finalizers,verbs=update
+//+kubebuilder:rbac:groups=hyperfoil.io,resources=horreumoperatorconfigs,verbs=get;list;watch
 //+kubebuilder:rbac:groups=core,resources=pods;services;services/finalizers;endpoints;persistentvolumeclaims;events;configmaps;secrets,verbs=get;list;watch;create;update;patch;delete
-//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=servicemonitors,verbs=get;create
+//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=servicemonitors;prometheusrules,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots,verbs=get;create
+//+kubebuilder:rbac:groups=operator.openshift.io,resources=imagecontentsourcepolicies,verbs=get;list;watch
+//+kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=validatingwebhookconfigurations,verbs=get;list;watch
 //+kubebuilder:rbac:groups=apps,resourceNames=horreum-operator,resources=deployments/finalizers,verbs=update
+//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=autoscaling,resources=horizontalpodautoscalers,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=route.openshift.io,resources=routes;routes/custom-host,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=security.openshift.io,resources=securitycontextconstraints,resourceNames=nonroot,verbs=use
 
@@ -80,6 +121,11 @@ var nocheck = func(interface{}) (bool, string, string) {
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.9.2/pkg/reconcile
 func (r *HorreumReconciler) Reconcile(ctx context.Context, request ctrl.Request) (ctrl.Result, error) {
 	logger := r.Log.WithValues("Request.Namespace", request.Namespace, "Request.Name", request.Name)
+	r = r.forReconcile()
+	if !r.watchesNamespace(request.Namespace) {
+		logger.Info("Namespace is not watched according to HorreumOperatorConfig, ignoring")
+		return reconcile.Result{}, nil
+	}
 	logger.Info("Reconciling Horreum")
 
 	// Fetch the Horreum cr
@@ -87,17 +133,47 @@ func (r *HorreumReconciler) Reconcile(ctx context.Context, request ctrl.Request)
 	err := r.Get(ctx, request.NamespacedName, cr)
 	if err != nil {
 		if errors.IsNotFound(err) {
+			deleteMetrics(request.Namespace, request.Name)
+			shutdownTracerProvider(request.NamespacedName)
 			return reconcile.Result{}, nil
 		}
 		return reconcile.Result{}, err
 	}
 
+	ctx, span := startReconcileSpan(ctx, r, cr)
+	defer endSpan(span, cr)
+
+	// Deletion policy is not applied while paused; the finalizer holds the resource until it is resumed
+	if cr.Spec.Paused {
+		return reconcile.Result{}, refreshPausedStatus(r, cr, logger)
+	}
+	setResumed(cr)
+
+	if !cr.DeletionTimestamp.IsZero() {
+		return finalize(r, cr, logger)
+	}
+	if err := ensureFinalizer(r, cr); err != nil {
+		return reconcile.Result{}, err
+	}
+	checkDeletionProtection(r, cr)
+
 	if cr.Spec.NodeHost == "" &&
 		(isNodePort(r, cr.Spec.ServiceType) || isNodePort(r, cr.Spec.Keycloak.ServiceType)) {
 		msg := "service of type NodePort is used but spec.nodeHost is not defined"
 		updateStatus(r, cr, "Error", msg)
 		return reconcile.Result{}, stdErrors.New(msg)
 	}
+	if cr.Spec.Mode == modeStopped && postgresDeployed(cr) && cr.Spec.Postgres.PersistentVolumeClaim == "" {
+		// Components are left as they are; the database uses ephemeral storage and stopping it would lose the data
+		msg := "mode Stopped requires spec.postgres.persistentVolumeClaim, the database would be lost"
+		recordEvent(r, cr, corev1.EventTypeWarning, "StopRejected", msg)
+		updateStatus(r, cr, "Error", msg)
+		return reconcile.Result{}, nil
+	}
+	if cr.Spec.TrustedCABundle == "" && (verifiesDatabase(&cr.Spec.Database) || verifiesDatabase(&cr.Spec.Keycloak.Database)) {
+		updateStatus(r, cr, "Error", "sslMode verify-ca and verify-full require spec.trustedCABundle")
+		return reconcile.Result{}, nil
+	}
 
 	if cr.Status.Status != "Ready" {
 		adminSecret := horreumAdminSecret(cr)
@@ -106,7 +182,9 @@ func (r *HorreumReconciler) Reconcile(ctx context.Context, request ctrl.Request)
 		cr.Status.LastUpdate = metav1.Now()
 	}
 
-	if !r.RoutesAvailable {
+	secretsPhase := startPhase(ctx, cr, "secrets")
+	defer secretsPhase.end()
+	if r.certificateProvider() == certificateProviderOperator {
 		ca, caPrivateKey, err := createCA(cr, r, logger)
 		if err != nil {
 			return reconcile.Result{}, err
@@ -134,12 +212,12 @@ func (r *HorreumReconciler) Reconcile(ctx context.Context, request ctrl.Request)
 		}
 	}
 
-	dbAdminSecret := newSecret(cr, dbAdminSecret(cr))
+	dbAdminSecret := newDatabaseSecret(cr, dbAdminSecret(cr))
 	if err := ensureSame(r, cr, logger, dbAdminSecret, &corev1.Secret{}, nocompare,
 		checkSecret(corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey)); err != nil {
 		return reconcile.Result{}, err
 	}
-	appSecret := newSecret(cr, appUserSecret(cr))
+	appSecret := newDatabaseSecret(cr, appUserSecret(cr))
 	appSecret.StringData["dbsecret"] = generatePassword()
 	if err := ensureSame(r, cr, logger, appSecret, &corev1.Secret{}, nocompare,
 		checkSecret(corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey, "dbsecret")); err != nil {
@@ -150,7 +228,7 @@ func (r *HorreumReconciler) Reconcile(ctx context.Context, request ctrl.Request)
 		checkSecret(corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey)); err != nil {
 		return reconcile.Result{}, err
 	}
-	keycloakDbSecret := newSecret(cr, keycloakDbSecret(cr))
+	keycloakDbSecret := newDatabaseSecret(cr, keycloakDbSecret(cr))
 	if err := ensureSame(r, cr, logger, keycloakDbSecret, &corev1.Secret{}, nocompare,
 		checkSecret(corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey)); err != nil {
 		return reconcile.Result{}, err
@@ -160,35 +238,92 @@ func (r *HorreumReconciler) Reconcile(ctx context.Context, request ctrl.Request)
 		checkSecret(corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey)); err != nil {
 		return reconcile.Result{}, err
 	}
+	if cr.Spec.Keycloak.Shared != nil {
+		if err := ensureSame(r, cr, logger, newKeycloakClientSecret(cr), &corev1.Secret{}, nocompare,
+			checkSecret(keycloakClientSecretKey)); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	secretsPhase.end()
+
+	networkPhase := startPhase(ctx, cr, "network")
+	defer networkPhase.end()
+	if err := ensureNetworkPolicies(r, cr, logger); err != nil {
+		return reconcile.Result{}, err
+	}
+	networkPhase.end()
 
+	databasePhase := startPhase(ctx, cr, "database")
+	defer databasePhase.end()
 	postgresConfigMap := postgresConfigMap(cr)
 	postgresPod := postgresPod(cr, r)
 	postgresService := postgresService(cr)
-	if cr.Spec.Postgres.Enabled != nil && !*cr.Spec.Postgres.Enabled {
+	if cr.Spec.Mode == modeStopped {
+		if err := ensureDeleted(r, cr, postgresPod, &corev1.Pod{}); err != nil {
+			return reconcile.Result{}, err
+		}
+	} else if !postgresDeployed(cr) {
 		if err := ensureDeleted(r, cr, postgresPod, &corev1.Pod{}); err != nil {
 			return reconcile.Result{}, err
 		}
 		if err := ensureDeleted(r, cr, postgresService, &corev1.Service{}); err != nil {
 			return reconcile.Result{}, err
 		}
+		if cr.Spec.Postgres.Shared != nil {
+			if ready, err := provisionSharedDatabase(r, cr, logger); err != nil {
+				return reconcile.Result{}, err
+			} else if !ready {
+				updateStatus(r, cr, "Pending", "Waiting for databases on shared PostgreSQL")
+				return sharedDatabaseRequeue(cr), nil
+			}
+		}
 	} else {
 		if err := ensureSame(r, cr, logger, postgresConfigMap, &corev1.ConfigMap{}, compareConfigMap, nocheck); err != nil {
 			return reconcile.Result{}, err
 		}
+		if err := setReferencesHash(r, postgresPod); err != nil {
+			return reconcile.Result{}, err
+		}
 		if err := ensureSame(r, cr, logger, postgresPod, &corev1.Pod{}, comparePods, checkPod); err != nil {
 			return reconcile.Result{}, err
 		}
 		if err := ensureSame(r, cr, logger, postgresService, &corev1.Service{}, compareService, nocheck); err != nil {
 			return reconcile.Result{}, err
 		}
+		if err := labelProtectedPVC(r, cr); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	databasePhase.end()
+
+	upgradeRequeue, err := reconcileUpgrade(r, cr, logger)
+	if err != nil {
+		return reconcile.Result{}, err
 	}
 
+	keycloakPhase := startPhase(ctx, cr, "keycloak")
+	defer keycloakPhase.end()
 	keycloakService := keycloakService(cr, r)
 	keycloakRoute, err := keycloakRoute(cr, r)
 	if err != nil {
 		return reconcile.Result{}, err
 	}
 	keycloakPublicUrl := cr.Spec.Keycloak.External.PublicUri
+	var keycloakProvider *hyperfoilv1alpha1.Horreum
+	if cr.Spec.Keycloak.Shared != nil {
+		keycloakProvider, err = sharedKeycloakProvider(r, cr)
+		if err != nil {
+			updateStatus(r, cr, "Error", "Cannot use shared Keycloak: "+err.Error())
+			return reconcile.Result{}, err
+		} else if keycloakProvider == nil || keycloakProvider.Status.KeycloakUrl == "" {
+			// Changes in the provider trigger reconciliation
+			updateStatus(r, cr, "Pending", "Waiting for shared Keycloak in Horreum "+sharedKeycloakProviderName(cr).String())
+			return reconcile.Result{}, nil
+		}
+		keycloakPublicUrl = keycloakProvider.Status.KeycloakUrl
+	}
 	if keycloakPublicUrl == "" {
 		if err := ensureSame(r, cr, logger, keycloakService, &corev1.Service{}, compareService, nocheck); err != nil {
 			return reconcile.Result{}, err
@@ -209,7 +344,7 @@ func (r *HorreumReconciler) Reconcile(ctx context.Context, request ctrl.Request)
 				if err != nil {
 					return reconcile.Result{}, err
 				}
-			} else if r.RoutesAvailable {
+			} else if r.useRoutes() {
 				foundRoute := &routev1.Route{}
 				if err := ensureSame(r, cr, logger, keycloakRoute, foundRoute, compareRoute, checkRoute); err != nil {
 					return reconcile.Result{}, err
@@ -225,23 +360,36 @@ func (r *HorreumReconciler) Reconcile(ctx context.Context, request ctrl.Request)
 	}
 	cr.Status.KeycloakUrl = keycloakPublicUrl
 
-	keycloakPod := keycloakPod(cr, keycloakPublicUrl)
-	if cr.Spec.Keycloak.External.PublicUri != "" {
+	keycloakPod := keycloakPod(cr, r, keycloakPublicUrl)
+	if !keycloakDeployed(cr) {
 		if err := ensureDeleted(r, cr, keycloakPod, &corev1.Pod{}); err != nil {
 			return reconcile.Result{}, err
 		}
 		if err := ensureDeleted(r, cr, keycloakService, &corev1.Service{}); err != nil {
 			return reconcile.Result{}, err
 		}
-		if r.RoutesAvailable {
+		if r.useRoutes() {
 			if err := ensureDeleted(r, cr, keycloakRoute, &routev1.Route{}); err != nil {
 				return reconcile.Result{}, err
 			}
 		}
-	} else if err := ensureSame(r, cr, logger, keycloakPod, &corev1.Pod{}, comparePods, checkPod); err != nil {
-		return reconcile.Result{}, err
+	} else if appStopped(cr) {
+		if err := ensureDeleted(r, cr, keycloakPod, &corev1.Pod{}); err != nil {
+			return reconcile.Result{}, err
+		}
+	} else {
+		if err := setReferencesHash(r, keycloakPod); err != nil {
+			return reconcile.Result{}, err
+		}
+		if err := ensureSame(r, cr, logger, keycloakPod, &corev1.Pod{}, comparePods, checkPod); err != nil {
+			return reconcile.Result{}, err
+		}
 	}
 
+	keycloakPhase.end()
+
+	appPhase := startPhase(ctx, cr, "app")
+	defer appPhase.end()
 	appService := appService(cr, r)
 	appRoute, err := appRoute(cr, r)
 	if err != nil {
@@ -267,7 +415,7 @@ func (r *HorreumReconciler) Reconcile(ctx context.Context, request ctrl.Request)
 			if err != nil {
 				return reconcile.Result{}, err
 			}
-		} else if r.RoutesAvailable {
+		} else if r.useRoutes() {
 			foundRoute := &routev1.Route{}
 			if err := ensureSame(r, cr, logger, appRoute, foundRoute, compareRoute, checkRoute); err != nil {
 				return reconcile.Result{}, err
@@ -282,8 +430,47 @@ func (r *HorreumReconciler) Reconcile(ctx context.Context, request ctrl.Request)
 	}
 	cr.Status.PublicUrl = appPublicUrl
 
-	appPod := appPod(cr, keycloakPublicUrl, appPublicUrl)
-	if err := ensureSame(r, cr, logger, appPod, &corev1.Pod{}, comparePods, checkPod); err != nil {
+	if keycloakProvider != nil {
+		if err := provisionSharedRealm(r, cr, logger, keycloakProvider, appPublicUrl); err != nil {
+			updateStatus(r, cr, "Error", "Cannot provision realm in shared Keycloak: "+err.Error())
+			return reconcile.Result{}, err
+		}
+	}
+	appPod := appPod(cr, r, keycloakPublicUrl, appPublicUrl)
+	if conflicts := configConflicts(cr, appPod); len(conflicts) > 0 {
+		msg := "spec.config cannot override properties set through environment: " + strings.Join(conflicts, ", ")
+		updateStatus(r, cr, "Error", msg)
+		return reconcile.Result{}, stdErrors.New(msg)
+	}
+	appConfigMap := appConfigMap(cr)
+	if len(cr.Spec.Config) == 0 {
+		if err := ensureDeleted(r, cr, appConfigMap, &corev1.ConfigMap{}); err != nil {
+			return reconcile.Result{}, err
+		}
+	} else if err := ensureSame(r, cr, logger, appConfigMap, &corev1.ConfigMap{}, compareConfigMap, nocheck); err != nil {
+		return reconcile.Result{}, err
+	}
+	// Previous versions of the operator ran Horreum as a standalone pod
+	if err := ensureDeleted(r, cr, appPod, &corev1.Pod{}); err != nil {
+		return reconcile.Result{}, err
+	}
+	if err := setReferencesHash(r, appPod); err != nil {
+		return reconcile.Result{}, err
+	}
+	appDeployment := appDeployment(cr, appPod)
+	if err := ensureUpdated(r, cr, logger, appDeployment, &appsv1.Deployment{}, compareDeployments, checkDeployment); err != nil {
+		return reconcile.Result{}, err
+	}
+	appAutoscaler := appAutoscaler(cr)
+	if cr.Spec.Autoscaling == nil || appScaledDown(cr) || appMigrating(cr) {
+		if err := ensureDeleted(r, cr, appAutoscaler, &autoscalingv2.HorizontalPodAutoscaler{}); err != nil {
+			return reconcile.Result{}, err
+		}
+	} else if err := ensureUpdated(r, cr, logger, appAutoscaler, &autoscalingv2.HorizontalPodAutoscaler{}, compareAutoscalers, nocheck); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if err := ensureMonitoring(r, cr, logger, appService, keycloakService); err != nil {
 		return reconcile.Result{}, err
 	}
 
@@ -292,9 +479,22 @@ func (r *HorreumReconciler) Reconcile(ctx context.Context, request ctrl.Request)
 		return reconcile.Result{}, err
 	}
 
+	if cr.Status.Upgrade == nil {
+		// Keep track of the running images, e.g. when these change through spec.image
+		if _, err := recordCurrentVersion(r, cr); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	appPhase.end()
+
+	if reason := modeReason(cr); reason != "" && cr.Status.Status == "Ready" {
+		setStatus(r, cr, cr.Spec.Mode, reason)
+	}
+
 	r.Status().Update(ctx, cr)
 
-	return reconcile.Result{}, nil
+	return reconcile.Result{RequeueAfter: upgradeRequeue}, nil
 }
 
 type resource interface {
@@ -305,39 +505,81 @@ type resource interface {
 func ensureSame(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger,
 	object resource, out client.Object,
 	compare compareFunc, check checkFunc) error {
-	// Set Hyperfoil instance as the owner and controller
-	if err := controllerutil.SetControllerReference(cr, object, r.Scheme); err != nil {
-		return err
+	return ensureObject(r, cr, logger, object, out, compare, check, false)
+}
+
+// ensureUpdated is similar to ensureSame but updates an existing object that does not match in place,
+// so that e.g. Deployment rolls out the change rather than terminating all pods at once
+func ensureUpdated(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger,
+	object resource, out client.Object,
+	compare compareFunc, check checkFunc) error {
+	return ensureObject(r, cr, logger, object, out, compare, check, true)
+}
+
+func ensureObject(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger,
+	object resource, out client.Object,
+	compare compareFunc, check checkFunc, inPlace bool) error {
+	// Set Hyperfoil instance as the owner and controller; objects in other namespaces (Jobs operating
+	// on shared PostgreSQL) cannot have owner references and are removed by the finalizer
+	if object.GetNamespace() == cr.Namespace {
+		if err := controllerutil.SetControllerReference(cr, object, r.Scheme); err != nil {
+			return err
+		}
 	}
 
-	kind := reflect.TypeOf(object).Elem().Name()
+	kind := kindOf(object)
+	component := componentOf(object)
 	// Check if this Pod already exists
 	err := r.Get(context.TODO(), types.NamespacedName{Name: object.GetName(), Namespace: object.GetNamespace()}, out)
 	if err != nil && errors.IsNotFound(err) {
 		logger.Info("Creating a new "+kind, kind+".Namespace", object.GetNamespace(), kind+".Name", object.GetName())
 		err = r.Create(context.TODO(), object)
 		if err != nil {
+			recordEvent(r, cr, corev1.EventTypeWarning, "CreateFailed", "Cannot create "+kind+" "+object.GetName()+": "+err.Error())
 			updateStatus(r, cr, "Error", "Cannot create "+kind+" "+object.GetName())
 			return err
 		}
+		recordEvent(r, cr, corev1.EventTypeNormal, "Created", "Created "+kind+" "+object.GetName())
+		recordComponentReady(cr, component, false)
 		setStatus(r, cr, "Pending", "Creating "+kind+" "+object.GetName())
 	} else if err != nil {
 		updateStatus(r, cr, "Error", "Cannot find "+kind+" "+object.GetName())
 		return err
 	} else if compare(object, out, logger) {
 		logger.Info(kind + " " + object.GetName() + " already exists and matches.")
-		if ok, status, reason := check(out); !ok {
+		ok, status, reason := check(out)
+		recordComponentReady(cr, component, ok)
+		if !ok {
+			if status == "Error" {
+				recordEvent(r, cr, corev1.EventTypeWarning, "Unhealthy", kind+" "+object.GetName()+reason)
+			}
 			setStatus(r, cr, status, kind+" "+object.GetName()+" "+reason)
 		}
+	} else if inPlace {
+		logger.Info(kind + " " + object.GetName() + " already exists but does not match. Updating existing object.")
+		recordEvent(r, cr, corev1.EventTypeNormal, "Updating", kind+" "+object.GetName()+" does not match desired state, updating")
+		preserveFields(object, out)
+		if err = r.Update(context.TODO(), object); err != nil {
+			recordEvent(r, cr, corev1.EventTypeWarning, "UpdateFailed", "Cannot update "+kind+" "+object.GetName()+": "+err.Error())
+			updateStatus(r, cr, "Error", "Cannot update "+kind+" "+object.GetName())
+			return err
+		}
+		setStatus(r, cr, "Pending", "Updating "+kind+" "+object.GetName())
 	} else {
 		logger.Info(kind + " " + object.GetName() + " already exists but does not match. Deleting existing object.")
-		if err = r.Delete(context.TODO(), out); err != nil {
+		recordEvent(r, cr, corev1.EventTypeNormal, "Recreating", kind+" "+object.GetName()+" does not match desired state, recreating")
+		recreatedObjects.WithLabelValues(cr.Namespace, cr.Name, kind).Inc()
+		recordComponentReady(cr, component, false)
+		// Jobs would orphan their pods by default
+		if err = r.Delete(context.TODO(), out, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil {
 			logger.Error(err, "Cannot delete "+kind+" "+object.GetName())
+			recordEvent(r, cr, corev1.EventTypeWarning, "DeleteFailed", "Cannot delete "+kind+" "+object.GetName()+": "+err.Error())
 			updateStatus(r, cr, "Error", "Cannot delete "+kind+" "+object.GetName())
 			return err
 		}
 		logger.Info("Creating a new " + kind)
 		if err = r.Create(context.TODO(), object); err != nil {
+			recordEvent(r, cr, corev1.EventTypeWarning, "CreateFailed", "Cannot create "+kind+" "+object.GetName()+": "+err.Error())
 			updateStatus(r, cr, "Error", "Cannot create "+kind+" "+object.GetName())
 			return err
 		}
@@ -346,8 +588,25 @@ func ensureSame(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr
 	return nil
 }
 
+// preserveFields copies resource version and fields managed by other controllers from the existing object
+func preserveFields(object resource, existing client.Object) {
+	object.SetResourceVersion(existing.GetResourceVersion())
+	annotations := existing.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	for key, value := range object.GetAnnotations() {
+		annotations[key] = value
+	}
+	object.SetAnnotations(annotations)
+	if deployment, ok := object.(*appsv1.Deployment); ok && deployment.Spec.Replicas == nil {
+		// Replicas are controlled by the autoscaler
+		deployment.Spec.Replicas = existing.(*appsv1.Deployment).Spec.Replicas
+	}
+}
+
 func ensureDeleted(r *HorreumReconciler, instance *hyperfoilv1alpha1.Horreum, object resource, out client.Object) error {
-	kind := reflect.TypeOf(object).Elem().Name()
+	kind := kindOf(object)
 	err := r.Get(context.TODO(), types.NamespacedName{Name: object.GetName(), Namespace: object.GetNamespace()}, out)
 	if err != nil && errors.IsNotFound(err) {
 		return nil
@@ -356,15 +615,43 @@ func ensureDeleted(r *HorreumReconciler, instance *hyperfoilv1alpha1.Horreum, ob
 		return err
 	} else {
 		if err = r.Delete(context.TODO(), out); err != nil {
+			recordEvent(r, instance, corev1.EventTypeWarning, "DeleteFailed", "Cannot delete "+kind+" "+object.GetName()+": "+err.Error())
 			updateStatus(r, instance, "Error", "Cannot delete "+kind+" "+object.GetName())
 			return err
 		}
+		recordEvent(r, instance, corev1.EventTypeNormal, "Deleted", "Deleted "+kind+" "+object.GetName())
+		if component := componentOf(object); component != "" {
+			componentReady.DeleteLabelValues(instance.Namespace, instance.Name, component)
+		}
 	}
 	return nil
 }
 
+func kindOf(object runtime.Object) string {
+	// Objects of optional APIs (e.g. ServiceMonitor) are handled as unstructured
+	if u, ok := object.(*unstructured.Unstructured); ok {
+		return u.GetKind()
+	}
+	return reflect.TypeOf(object).Elem().Name()
+}
+
+// componentOf returns the component label for workloads; other objects are not tracked in metrics
+func componentOf(object resource) string {
+	switch object.(type) {
+	case *corev1.Pod, *appsv1.Deployment:
+		return object.GetLabels()["service"]
+	}
+	return ""
+}
+
+func recordEvent(r *HorreumReconciler, instance *hyperfoilv1alpha1.Horreum, eventType string, reason string, message string) {
+	if r.Recorder != nil {
+		r.Recorder.Event(instance, eventType, reason, message)
+	}
+}
+
 func isNodePort(r *HorreumReconciler, serviceType corev1.ServiceType) bool {
-	return serviceType == corev1.ServiceTypeNodePort || serviceType == "" && !r.RoutesAvailable
+	return serviceType == corev1.ServiceTypeNodePort || serviceType == "" && !r.useRoutes()
 }
 
 func getNodePort(r *HorreumReconciler, service *corev1.Service, logger logr.Logger) (int32, error) {
@@ -447,6 +734,13 @@ func comparePods(i1 interface{}, i2 interface{}, logger logr.Logger) bool {
 		return false
 	}
 
+	if !equality.Semantic.DeepDerivative(p1.Labels, p2.Labels) ||
+		!equality.Semantic.DeepDerivative(p1.Annotations, p2.Annotations) {
+		logger.Info("Pod " + p1.GetName() + " labels or annotations differ: " +
+			fmt.Sprintf("%v %v | %v %v", p1.Labels, p1.Annotations, p2.Labels, p2.Annotations))
+		return false
+	}
+
 	if equality.Semantic.DeepDerivative(p1.Spec, p2.Spec) {
 		return true
 	}
@@ -456,6 +750,66 @@ func comparePods(i1 interface{}, i2 interface{}, logger logr.Logger) bool {
 	return false
 }
 
+func compareDeployments(i1 interface{}, i2 interface{}, logger logr.Logger) bool {
+	d1, ok1 := i1.(*appsv1.Deployment)
+	d2, ok2 := i2.(*appsv1.Deployment)
+	if !ok1 || !ok2 {
+		logger.Info("Cannot cast to Deployments: " + fmt.Sprintf("%v | %v", i1, i2))
+		return false
+	}
+
+	if equality.Semantic.DeepDerivative(d1.Spec, d2.Spec) {
+		return true
+	}
+
+	diff := cmp.Diff(d1.Spec, d2.Spec)
+	logger.Info("Deployment " + d1.GetName() + " diff (-want,+got):\n" + diff)
+	return false
+}
+
+func compareJobs(i1 interface{}, i2 interface{}, logger logr.Logger) bool {
+	j1, ok1 := i1.(*batchv1.Job)
+	j2, ok2 := i2.(*batchv1.Job)
+	if !ok1 || !ok2 {
+		logger.Info("Cannot cast to Jobs: " + fmt.Sprintf("%v | %v", i1, i2))
+		return false
+	}
+	// Template of a Job cannot be updated, any change requires running the Job again
+	return equality.Semantic.DeepDerivative(j1.Annotations, j2.Annotations) &&
+		equality.Semantic.DeepDerivative(j1.Spec.Template, j2.Spec.Template)
+}
+
+func compareNetworkPolicies(i1 interface{}, i2 interface{}, logger logr.Logger) bool {
+	p1, ok1 := i1.(*networkingv1.NetworkPolicy)
+	p2, ok2 := i2.(*networkingv1.NetworkPolicy)
+	if !ok1 || !ok2 {
+		logger.Info("Cannot cast to NetworkPolicies: " + fmt.Sprintf("%v | %v", i1, i2))
+		return false
+	}
+	// The policies are fully specified; DeepDerivative would miss a rule that allows all (empty From)
+	return equality.Semantic.DeepEqual(p1.Spec, p2.Spec)
+}
+
+func compareSecretData(i1 interface{}, i2 interface{}, logger logr.Logger) bool {
+	s1, ok1 := i1.(*corev1.Secret)
+	s2, ok2 := i2.(*corev1.Secret)
+	if !ok1 || !ok2 {
+		logger.Info("Cannot cast to Secrets: " + fmt.Sprintf("%v | %v", i1, i2))
+		return false
+	}
+	return equality.Semantic.DeepEqual(s1.Data, s2.Data)
+}
+
+func compareAutoscalers(i1 interface{}, i2 interface{}, logger logr.Logger) bool {
+	a1, ok1 := i1.(*autoscalingv2.HorizontalPodAutoscaler)
+	a2, ok2 := i2.(*autoscalingv2.HorizontalPodAutoscaler)
+	if !ok1 || !ok2 {
+		logger.Info("Cannot cast to HorizontalPodAutoscalers: " + fmt.Sprintf("%v | %v", i1, i2))
+		return false
+	}
+	return equality.Semantic.DeepDerivative(a1.Spec, a2.Spec)
+}
+
 func uploadConfig(cr *hyperfoilv1alpha1.Horreum) *corev1.ConfigMap {
 	keycloakURL := keycloakInternalURL(cr)
 	horreumURL := innerProtocol(cr.Spec.Route) + cr.Name + "." + cr.Namespace + `.svc`
@@ -468,7 +822,7 @@ func uploadConfig(cr *hyperfoilv1alpha1.Horreum) *corev1.ConfigMap {
 			"50-upload-to-horreum": `
 			#!/bin/bash
 
-			TOKEN=$(curl -s -X POST	` + keycloakURL + `/auth/realms/horreum/protocol/openid-connect/token ` +
+			TOKEN=$(curl -s -X POST	` + keycloakURL + `/auth/realms/` + keycloakRealm(cr) + `/protocol/openid-connect/token ` +
 				` -H 'content-type: application/x-www-form-urlencoded' ` +
 				` -d 'username='$HORREUM_USER'&password='$HORREUM_PASSWORD'&grant_type=password&client_id=horreum-ui'` +
 				` | jq -r .access_token)
@@ -518,6 +872,45 @@ func checkPod(i interface{}) (bool, string, string) {
 	return false, "Pending", " is not ready"
 }
 
+func checkJob(i interface{}) (bool, string, string) {
+	job, ok := i.(*batchv1.Job)
+	if !ok {
+		return false, "Error", " is not a job"
+	}
+	for _, c := range job.Status.Conditions {
+		if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+			return false, "Error", " has failed: " + c.Message
+		}
+	}
+	if job.Status.Succeeded > 0 {
+		return true, "", ""
+	}
+	return false, "Pending", " is running"
+}
+
+func checkDeployment(i interface{}) (bool, string, string) {
+	deployment, ok := i.(*appsv1.Deployment)
+	if !ok {
+		return false, "Error", " is not a deployment"
+	}
+	for _, c := range deployment.Status.Conditions {
+		if c.Type == appsv1.DeploymentReplicaFailure && c.Status == corev1.ConditionTrue {
+			return false, "Error", " cannot create pods: " + c.Message
+		}
+	}
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	if deployment.Status.ObservedGeneration < deployment.Generation || deployment.Status.UpdatedReplicas < replicas {
+		return false, "Pending", " is being updated"
+	}
+	if deployment.Status.ReadyReplicas < replicas {
+		return false, "Pending", " is not ready"
+	}
+	return true, "", ""
+}
+
 func compareService(i1, i2 interface{}, logger logr.Logger) bool {
 	s1, ok1 := i1.(*corev1.Service)
 	s2, ok2 := i2.(*corev1.Service)
@@ -550,6 +943,10 @@ func compareRoute(i1, i2 interface{}, logger logr.Logger) bool {
 		logger.Info("Cannot cast to Routes: " + fmt.Sprintf("%v | %v", i1, i2))
 		return false
 	}
+	if !reflect.DeepEqual(r1.Spec.Port, r2.Spec.Port) {
+		logger.Info("Target port does not match: " + fmt.Sprintf("%v | %v", r1.Spec.Port, r2.Spec.Port))
+		return false
+	}
 	if r1.Spec.Host == "" {
 		return r1.Spec.Subdomain == r2.Spec.Subdomain
 	}
@@ -606,11 +1003,45 @@ func (r *HorreumReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	controller := ctrl.NewControllerManagedBy(mgr).
 		For(&hyperfoilv1alpha1.Horreum{}).
 		Owns(&corev1.Pod{}).
+		Owns(&appsv1.Deployment{}).
+		Owns(&batchv1.Job{}).
+		Owns(&networkingv1.NetworkPolicy{}).
+		Owns(&autoscalingv2.HorizontalPodAutoscaler{}).
 		Owns(&corev1.Service{}).
 		Owns(&corev1.Secret{}).
 		Owns(&corev1.ConfigMap{})
+	// Watch also secrets and config maps the operator does not own but pods reference; these share the informers
+	// with owned objects, and events for owned objects are already handled by Owns
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &hyperfoilv1alpha1.Horreum{}, referencesIndex, indexReferences); err != nil {
+		return err
+	}
+	notOwned := builder.WithPredicates(predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		owner := metav1.GetControllerOf(obj)
+		return owner == nil || owner.Kind != "Horreum"
+	}))
+	controller = controller.
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.findReferencingHorreums), notOwned).
+		Watches(&source.Kind{Type: &corev1.ConfigMap{}}, handler.EnqueueRequestsFromMapFunc(r.findReferencingHorreums), notOwned)
+	// Resources using shared Keycloak or PostgreSQL wait for the Horreum resource deploying it
+	controller = controller.Watches(&source.Kind{Type: &hyperfoilv1alpha1.Horreum{}},
+		handler.EnqueueRequestsFromMapFunc(r.findSharedKeycloakConsumers))
+	controller = controller.Watches(&source.Kind{Type: &hyperfoilv1alpha1.Horreum{}},
+		handler.EnqueueRequestsFromMapFunc(r.findSharedPostgresConsumers))
+	// Network policies of the shared components admit pods of the resources using them
+	controller = controller.Watches(&source.Kind{Type: &hyperfoilv1alpha1.Horreum{}},
+		handler.EnqueueRequestsFromMapFunc(r.findSharedProviders))
+	if len(r.WatchNamespaces) == 0 {
+		// Changes are picked up on the next reconciliation when the operator is limited to some namespaces
+		controller = controller.Watches(&source.Kind{Type: &hyperfoilv1alpha1.HorreumOperatorConfig{}},
+			handler.EnqueueRequestsFromMapFunc(r.findAllHorreums))
+	}
 	if r.RoutesAvailable {
 		controller = controller.Owns(&routev1.Route{})
 	}
+	if r.MonitoringAvailable {
+		controller = controller.
+			Owns(newUnstructured(serviceMonitorKind)).
+			Owns(newUnstructured(prometheusRuleKind))
+	}
 	return controller.Complete(r)
 }
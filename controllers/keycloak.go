@@ -3,6 +3,7 @@ package horreum
 import (
 	"errors"
 	"net/url"
+	"strconv"
 
 	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
 	routev1 "github.com/openshift/api/route/v1"
@@ -11,7 +12,7 @@ import (
 	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
-func keycloakPod(cr *hyperfoilv1alpha1.Horreum, keycloakPublicUrl string) *corev1.Pod {
+func keycloakPod(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler, keycloakPublicUrl string) *corev1.Pod {
 	secretName := cr.Name + "-keycloak-certs"
 	if cr.Spec.Keycloak.Route.Type == "passthrough" {
 		secretName = cr.Spec.Keycloak.Route.TLS
@@ -20,7 +21,7 @@ func keycloakPod(cr *hyperfoilv1alpha1.Horreum, keycloakPublicUrl string) *corev
 	if err != nil {
 		return nil
 	}
-	// TODO: setup X509_CA_BUNDLE
+	proxy := keycloakProxy(cr, r)
 	volumes := []corev1.Volume{
 		{
 			Name: "certs",
@@ -37,8 +38,111 @@ func keycloakPod(cr *hyperfoilv1alpha1.Horreum, keycloakPublicUrl string) *corev
 			MountPath: "/etc/x509/https",
 		},
 	}
+	env := []corev1.EnvVar{
+		secretEnv("KEYCLOAK_ADMIN", keycloakAdminSecret(cr), corev1.BasicAuthUsernameKey),
+		secretEnv("KEYCLOAK_ADMIN_PASSWORD", keycloakAdminSecret(cr), corev1.BasicAuthPasswordKey),
+		{
+			Name:  "DB_ADDR",
+			Value: withDefault(cr.Spec.Keycloak.Database.Host, dbDefaultHost(cr)),
+		},
+		{
+			Name:  "DB_PORT",
+			Value: withDefaultInt(cr.Spec.Keycloak.Database.Port, dbDefaultPort(cr)),
+		},
+		{
+			Name:  "DB_DATABASE",
+			Value: keycloakDatabaseName(cr),
+		},
+		// For simplicity of development the image has HTTP enabled, which is not suitable for production
+		{
+			Name:  "KC_HTTP_ENABLED",
+			Value: ifThenElse(proxy == "edge", "true", "false"),
+		},
+		{
+			Name:  "KC_HTTPS_PORT",
+			Value: "8443",
+		},
+		{
+			Name:  "KC_HTTPS_CERTIFICATE_FILE",
+			Value: "/etc/x509/https/tls.crt",
+		},
+		{
+			Name:  "KC_HTTPS_CERTIFICATE_KEY_FILE",
+			Value: "/etc/x509/https/tls.key",
+		},
+		{
+			Name:  "KC_HOSTNAME",
+			Value: withDefault(cr.Spec.Keycloak.Hostname, publicUrl.Hostname()),
+		},
+		{
+			Name:  "KC_PROXY",
+			Value: proxy,
+		},
+		dbUserEnv(cr, "KC_DB_USERNAME", keycloakDbSecret(cr)),
+		secretEnv("KC_DB_PASSWORD", keycloakDbSecret(cr), corev1.BasicAuthPasswordKey),
+		{
+			Name:  "KEYCLOAK_COMMAND",
+			Value: "start",
+		},
+		{
+			Name:  "KC_HEALTH_ENABLED",
+			Value: "true",
+		},
+	}
+	// Behind a proxy Keycloak uses the default port for the scheme
+	if publicUrl.Port() != "" && cr.Spec.Keycloak.Hostname == "" && (proxy == "none" || proxy == "passthrough") {
+		env = append(env, corev1.EnvVar{
+			Name:  "KC_HOSTNAME_PORT",
+			Value: publicUrl.Port(),
+		})
+	}
+	if properties := dbURLProperties(&cr.Spec.Keycloak.Database, "/etc/x509/trusted-ca"); properties != "" {
+		env = append(env, corev1.EnvVar{
+			Name:  "KC_DB_URL_PROPERTIES",
+			Value: properties,
+		})
+	}
+	if cr.Spec.Keycloak.HostnameStrict != nil {
+		env = append(env, corev1.EnvVar{
+			Name:  "KC_HOSTNAME_STRICT",
+			Value: strconv.FormatBool(*cr.Spec.Keycloak.HostnameStrict),
+		})
+	}
+	if cr.Spec.Keycloak.HostnameStrictHttps != nil {
+		env = append(env, corev1.EnvVar{
+			Name:  "KC_HOSTNAME_STRICT_HTTPS",
+			Value: strconv.FormatBool(*cr.Spec.Keycloak.HostnameStrictHttps),
+		})
+	}
+	env = append(env, keycloakTracingEnv(cr)...)
+	if monitoringEnabled(cr, r) {
+		env = append(env, corev1.EnvVar{
+			Name:  "KC_METRICS_ENABLED",
+			Value: "true",
+		})
+	}
+	ports := []corev1.ContainerPort{
+		{
+			Name:          "https",
+			ContainerPort: 8443,
+		},
+	}
+	if proxy == "edge" {
+		ports = append(ports, corev1.ContainerPort{
+			Name:          "http",
+			ContainerPort: 8080,
+		})
+	}
+	if cr.Spec.TrustedCABundle != "" {
+		volumes = append(volumes, trustedCAVolume(cr))
+		volumeMounts = append(volumeMounts, trustedCAMount("/etc/x509/trusted-ca"))
+		env = append(env, corev1.EnvVar{
+			Name:  "KC_TRUSTSTORE_PATHS",
+			Value: "/etc/x509/trusted-ca/" + trustedCABundleKey,
+		})
+	}
 
-	return &corev1.Pod{
+	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      cr.Name + "-keycloak",
 			Namespace: cr.Namespace,
@@ -50,89 +154,78 @@ func keycloakPod(cr *hyperfoilv1alpha1.Horreum, keycloakPublicUrl string) *corev
 		Spec: corev1.PodSpec{
 			Containers: []corev1.Container{
 				{
-					Name:  "keycloak",
-					Image: withDefault(cr.Spec.Keycloak.Image, "quay.io/hyperfoil/horreum-keycloak:latest"),
-					Env: []corev1.EnvVar{
-						secretEnv("KEYCLOAK_ADMIN", keycloakAdminSecret(cr), corev1.BasicAuthUsernameKey),
-						secretEnv("KEYCLOAK_ADMIN_PASSWORD", keycloakAdminSecret(cr), corev1.BasicAuthPasswordKey),
-						{
-							Name:  "DB_ADDR",
-							Value: withDefault(cr.Spec.Keycloak.Database.Host, dbDefaultHost(cr)),
-						},
-						{
-							Name:  "DB_PORT",
-							Value: withDefaultInt(cr.Spec.Keycloak.Database.Port, 5432),
-						},
-						{
-							Name:  "DB_DATABASE",
-							Value: withDefault(cr.Spec.Keycloak.Database.Name, "keycloak"),
-						},
-						// For simplicity of development the image has HTTP enabled, which is not suitable for production
-						{
-							Name:  "KC_HTTP_ENABLED",
-							Value: "false",
-						},
-						{
-							Name:  "KC_HTTPS_PORT",
-							Value: "8443",
-						},
-						{
-							Name:  "KC_HTTPS_CERTIFICATE_FILE",
-							Value: "/etc/x509/https/tls.crt",
-						},
-						{
-							Name:  "KC_HTTPS_CERTIFICATE_KEY_FILE",
-							Value: "/etc/x509/https/tls.key",
-						},
-						{
-							Name:  "KC_HOSTNAME",
-							Value: publicUrl.Host,
-						},
-						{
-							Name:  "KC_PROXY",
-							Value: "passthrough", // TODO at least for NodePort?
-						},
-						secretEnv("KC_DB_USERNAME", keycloakDbSecret(cr), corev1.BasicAuthUsernameKey),
-						secretEnv("KC_DB_PASSWORD", keycloakDbSecret(cr), corev1.BasicAuthPasswordKey),
-						{
-							Name:  "KEYCLOAK_COMMAND",
-							Value: "start",
-						},
-					},
-					Ports: []corev1.ContainerPort{
-						{
-							Name:          "https",
-							ContainerPort: 8443,
-						},
-					},
-					VolumeMounts: volumeMounts,
+					Name:           "keycloak",
+					Image:          r.mirrorImage(keycloakImage(cr, r)),
+					Env:            env,
+					Ports:          ports,
+					VolumeMounts:   volumeMounts,
+					Resources:      withDefaultResources(cr.Spec.Keycloak.Resources, r.operatorConfig().Resources.Keycloak),
+					StartupProbe:   withDefaultProbe(cr.Spec.Keycloak.Probes.Startup, httpProbe("/health/started", 8443, corev1.URISchemeHTTPS, 5, 60)),
+					LivenessProbe:  withDefaultProbe(cr.Spec.Keycloak.Probes.Liveness, httpProbe("/health/live", 8443, corev1.URISchemeHTTPS, 10, 3)),
+					ReadinessProbe: withDefaultProbe(cr.Spec.Keycloak.Probes.Readiness, httpProbe("/health/ready", 8443, corev1.URISchemeHTTPS, 10, 3)),
 				},
 			},
 			Volumes: volumes,
 		},
 	}
+	applyScheduling(&pod.Spec, &cr.Spec.Keycloak.SchedulingSpec)
+	applyCustomization(pod, &cr.Spec.Keycloak.PodCustomizationSpec)
+	return pod
+}
+
+// keycloakProxy selects reverse proxy mode based on the way Keycloak is exposed
+func keycloakProxy(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) string {
+	if cr.Spec.Keycloak.Proxy != "" {
+		return cr.Spec.Keycloak.Proxy
+	}
+	if isNodePort(r, cr.Spec.Keycloak.ServiceType) {
+		return "none"
+	} else if cr.Spec.Keycloak.ServiceType == corev1.ServiceTypeLoadBalancer {
+		return "passthrough"
+	} else if r.useRoutes() {
+		switch cr.Spec.Keycloak.Route.Type {
+		case "passthrough", "edge":
+			return cr.Spec.Keycloak.Route.Type
+		}
+		return "reencrypt"
+	}
+	return "none"
 }
 
 func keycloakService(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) *corev1.Service {
+	ports := []corev1.ServicePort{
+		{
+			Name: "https",
+			Port: int32(443),
+			TargetPort: intstr.IntOrString{
+				IntVal: 8443,
+			},
+		},
+	}
+	if keycloakProxy(cr, r) == "edge" {
+		ports = append(ports, corev1.ServicePort{
+			Name: "http",
+			Port: int32(80),
+			TargetPort: intstr.IntOrString{
+				IntVal: 8080,
+			},
+		})
+	}
 	return &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      cr.Name + "-keycloak",
 			Namespace: cr.Namespace,
+			Labels: map[string]string{
+				"app":     cr.Name,
+				"service": "keycloak",
+			},
 			Annotations: map[string]string{
 				"service.beta.openshift.io/serving-cert-secret-name": cr.Name + "-keycloak-certs",
 			},
 		},
 		Spec: corev1.ServiceSpec{
-			Type: serviceType(cr.Spec.Keycloak.ServiceType, r),
-			Ports: []corev1.ServicePort{
-				{
-					Name: "https",
-					Port: int32(443),
-					TargetPort: intstr.IntOrString{
-						IntVal: 8443,
-					},
-				},
-			},
+			Type:  serviceType(cr.Spec.Keycloak.ServiceType, r),
+			Ports: ports,
 			Selector: map[string]string{
 				"app":     cr.Name,
 				"service": "keycloak",
@@ -143,8 +236,11 @@ func keycloakService(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) *corev
 
 func keycloakRoute(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) (*routev1.Route, error) {
 	routeType := cr.Spec.Keycloak.Route.Type
-	if routeType != "passthrough" && routeType != "reencrypt" && routeType != "" {
+	if routeType != "passthrough" && routeType != "reencrypt" && routeType != "edge" && routeType != "" {
 		return nil, errors.New("keycloak supports only TLS-encrypted routes")
+	} else if routeType == "edge" && keycloakProxy(cr, r) != "edge" {
+		// Keycloak listens on plain-text HTTP port only in proxy mode 'edge'
+		return nil, errors.New("keycloak edge route requires proxy mode 'edge'")
 	}
 	return route(cr.Spec.Keycloak.Route, "-keycloak", cr, r)
 }
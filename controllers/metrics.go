@@ -0,0 +1,118 @@
+package horreum
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"time"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	componentReady = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "horreum_component_ready",
+		Help: "Whether the component (app, keycloak or db) of Horreum instance is ready (1) or not (0)",
+	}, []string{"namespace", "name", "component"})
+	certificateExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "horreum_certificate_expiry_days",
+		Help: "Days until expiration of certificate generated by the operator; certificate label is the name of the secret",
+	}, []string{"namespace", "name", "certificate"})
+	certificateExpiryThreshold = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "horreum_certificate_expiry_threshold_days",
+		Help: "Days before certificate expiration when an alert should fire; set only for instances with monitoring enabled",
+	}, []string{"namespace", "name"})
+	reconcileDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "horreum_reconcile_duration_seconds",
+		Help: "Duration of reconciliation phases (secrets, network, database, keycloak, app)",
+	}, []string{"namespace", "name", "phase"})
+	recreatedObjects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "horreum_recreated_objects_total",
+		Help: "Number of objects deleted and created again because they did not match the desired state",
+	}, []string{"namespace", "name", "kind"})
+	lastBackup = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "horreum_last_backup_timestamp_seconds",
+		Help: "Unix timestamp of the last database backup",
+	}, []string{"namespace", "name"})
+)
+
+var metricComponents = []string{"app", "keycloak", "db"}
+var metricCertificateSuffixes = []string{"-ca-certs", "-app-certs", "-keycloak-certs"}
+var metricPhases = []string{"secrets", "network", "database", "keycloak", "app"}
+
+// Kinds of objects passed to ensureSame and ensureUpdated; series of recreated objects are deleted by kind
+var metricKinds = []string{"Pod", "Deployment", "HorizontalPodAutoscaler", "Service", "Route", "ConfigMap", "Secret",
+	"Job", "NetworkPolicy", "ServiceMonitor", "PrometheusRule"}
+
+func init() {
+	// Registered with controller-runtime registry to be exposed on the manager's metrics endpoint
+	metrics.Registry.MustRegister(componentReady, certificateExpiry, certificateExpiryThreshold, reconcileDuration, recreatedObjects, lastBackup)
+}
+
+type phaseTimer struct {
+	cr    *hyperfoilv1alpha1.Horreum
+	phase string
+	start time.Time
+	span  trace.Span
+	ended bool
+}
+
+// startPhase measures the phase duration and records it as a child span of the span in context, if present.
+// Callers should defer end() so that the phase is recorded also when the reconciliation returns early.
+func startPhase(ctx context.Context, cr *hyperfoilv1alpha1.Horreum, phase string) *phaseTimer {
+	_, span := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, phase)
+	return &phaseTimer{cr: cr, phase: phase, start: time.Now(), span: span}
+}
+
+// end records the phase; subsequent calls have no effect
+func (t *phaseTimer) end() {
+	if t.ended {
+		return
+	}
+	t.ended = true
+	endSpan(t.span, t.cr)
+	reconcileDuration.WithLabelValues(t.cr.Namespace, t.cr.Name, t.phase).Observe(time.Since(t.start).Seconds())
+}
+
+func recordComponentReady(cr *hyperfoilv1alpha1.Horreum, component string, ready bool) {
+	if component == "" {
+		return
+	}
+	value := 0.0
+	if ready {
+		value = 1.0
+	}
+	componentReady.WithLabelValues(cr.Namespace, cr.Name, component).Set(value)
+}
+
+func recordCertificateExpiry(cr *hyperfoilv1alpha1.Horreum, certificate string, certPEM []byte) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return
+	}
+	certificateExpiry.WithLabelValues(cr.Namespace, cr.Name, certificate).Set(time.Until(cert.NotAfter).Hours() / 24)
+}
+
+func deleteMetrics(namespace string, name string) {
+	for _, component := range metricComponents {
+		componentReady.DeleteLabelValues(namespace, name, component)
+	}
+	for _, suffix := range metricCertificateSuffixes {
+		certificateExpiry.DeleteLabelValues(namespace, name, name+suffix)
+	}
+	for _, phase := range metricPhases {
+		reconcileDuration.DeleteLabelValues(namespace, name, phase)
+	}
+	for _, kind := range metricKinds {
+		recreatedObjects.DeleteLabelValues(namespace, name, kind)
+	}
+	certificateExpiryThreshold.DeleteLabelValues(namespace, name)
+	lastBackup.DeleteLabelValues(namespace, name)
+}
@@ -0,0 +1,102 @@
+package horreum
+
+import (
+	"context"
+	stdErrors "errors"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// ImageMirror replaces registry or repository prefix Source in image references with Mirror
+type ImageMirror struct {
+	Source string
+	Mirror string
+}
+
+var imageContentSourcePolicyListKind = schema.GroupVersionKind{Group: "operator.openshift.io", Version: "v1alpha1", Kind: "ImageContentSourcePolicyList"}
+
+// ParseImageMirrors parses comma-separated list of `source=mirror` pairs, e.g. `quay.io/hyperfoil=registry.local/hyperfoil`
+func ParseImageMirrors(value string) ([]ImageMirror, error) {
+	mirrors := []ImageMirror{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		source, mirror, ok := strings.Cut(pair, "=")
+		if !ok || source == "" || mirror == "" {
+			return nil, stdErrors.New("invalid image mirror '" + pair + "', expected source=mirror")
+		}
+		mirrors = append(mirrors, ImageMirror{Source: strings.TrimSuffix(source, "/"), Mirror: strings.TrimSuffix(mirror, "/")})
+	}
+	return mirrors, nil
+}
+
+// mirrorImage rewrites the image using the operator's mirror table; when there's no match OpenShift
+// ImageContentSourcePolicies are consulted for images referenced by tag. Pulls by digest are redirected
+// by the cluster itself so these are left intact.
+func (r *HorreumReconciler) mirrorImage(image string) string {
+	if mirrored, ok := rewriteImage(image, r.ImageMirrors); ok {
+		return mirrored
+	}
+	if !r.MirrorPoliciesAvailable || strings.Contains(image, "@") {
+		return image
+	}
+	policyMirrors := r.policyMirrors
+	if policyMirrors == nil {
+		policyMirrors = r.imageContentSourceMirrors()
+	}
+	if mirrored, ok := rewriteImage(image, policyMirrors); ok {
+		return mirrored
+	}
+	return image
+}
+
+// rewriteImage applies the longest matching source; the source must match whole path components
+func rewriteImage(image string, mirrors []ImageMirror) (string, bool) {
+	best := -1
+	for i, m := range mirrors {
+		if !strings.HasPrefix(image, m.Source) {
+			continue
+		}
+		if rest := image[len(m.Source):]; rest != "" && !strings.ContainsAny(rest[:1], "/:@") {
+			continue
+		}
+		if best < 0 || len(m.Source) > len(mirrors[best].Source) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return image, false
+	}
+	return mirrors[best].Mirror + image[len(mirrors[best].Source):], true
+}
+
+// imageContentSourceMirrors lists mirrors from all policies; reconciliation uses the list read by forReconcile
+func (r *HorreumReconciler) imageContentSourceMirrors() []ImageMirror {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(imageContentSourcePolicyListKind)
+	if err := r.clusterReader().List(context.TODO(), list); err != nil {
+		r.logClusterReadError(err, "ImageContentSourcePolicies")
+		return []ImageMirror{}
+	}
+	mirrors := []ImageMirror{}
+	for _, policy := range list.Items {
+		repositories, _, _ := unstructured.NestedSlice(policy.Object, "spec", "repositoryDigestMirrors")
+		for _, item := range repositories {
+			repository, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			source, _, _ := unstructured.NestedString(repository, "source")
+			candidates, _, _ := unstructured.NestedStringSlice(repository, "mirrors")
+			// The first mirror is the preferred one
+			if source != "" && len(candidates) > 0 {
+				mirrors = append(mirrors, ImageMirror{Source: source, Mirror: candidates[0]})
+			}
+		}
+	}
+	return mirrors
+}
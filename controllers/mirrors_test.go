@@ -0,0 +1,69 @@
+package horreum
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseImageMirrors(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []ImageMirror
+		wantErr bool
+	}{
+		{value: "", want: []ImageMirror{}},
+		{
+			value: "quay.io/hyperfoil=registry.local/hyperfoil",
+			want:  []ImageMirror{{Source: "quay.io/hyperfoil", Mirror: "registry.local/hyperfoil"}},
+		},
+		{
+			value: " quay.io/=mirror.local/ , docker.io=hub.local,,",
+			want:  []ImageMirror{{Source: "quay.io", Mirror: "mirror.local"}, {Source: "docker.io", Mirror: "hub.local"}},
+		},
+		{value: "quay.io", wantErr: true},
+		{value: "=mirror.local", wantErr: true},
+		{value: "quay.io=", wantErr: true},
+		{value: "quay.io=mirror.local,docker.io", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseImageMirrors(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseImageMirrors(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+		} else if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseImageMirrors(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRewriteImage(t *testing.T) {
+	mirrors := []ImageMirror{
+		{Source: "quay.io", Mirror: "mirror.local"},
+		{Source: "quay.io/hyperfoil", Mirror: "registry.local/hf"},
+		{Source: "docker.io/library/postgres", Mirror: "registry.local/postgres"},
+	}
+	tests := []struct {
+		name    string
+		image   string
+		mirrors []ImageMirror
+		want    string
+		ok      bool
+	}{
+		{"longest source", "quay.io/hyperfoil/horreum:0.7", mirrors, "registry.local/hf/horreum:0.7", true},
+		{"registry", "quay.io/keycloak/keycloak:20.0", mirrors, "mirror.local/keycloak/keycloak:20.0", true},
+		{"partial path component", "quay.io/hyperfoilx/horreum", mirrors, "mirror.local/hyperfoilx/horreum", true},
+		{"repository with tag", "docker.io/library/postgres:14", mirrors, "registry.local/postgres:14", true},
+		{"repository with digest", "docker.io/library/postgres@sha256:abc", mirrors, "registry.local/postgres@sha256:abc", true},
+		{"repository without tag", "docker.io/library/postgres", mirrors, "registry.local/postgres", true},
+		{"different repository", "docker.io/library/postgresql:14", mirrors, "docker.io/library/postgresql:14", false},
+		{"no match", "registry.redhat.io/rhel8/postgresql-12", mirrors, "registry.redhat.io/rhel8/postgresql-12", false},
+		{"no mirrors", "quay.io/hyperfoil/horreum:0.7", nil, "quay.io/hyperfoil/horreum:0.7", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := rewriteImage(tt.image, tt.mirrors)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("rewriteImage(%q) = %q, %v, want %q, %v", tt.image, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
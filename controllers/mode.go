@@ -0,0 +1,26 @@
+package horreum
+
+import (
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+)
+
+const (
+	modeMaintenance = "Maintenance"
+	modeStopped     = "Stopped"
+)
+
+// appStopped returns true when Horreum application should not be running
+func appStopped(cr *hyperfoilv1alpha1.Horreum) bool {
+	return cr.Spec.Mode == modeMaintenance || cr.Spec.Mode == modeStopped
+}
+
+// modeReason explains the status when not all components are supposed to run
+func modeReason(cr *hyperfoilv1alpha1.Horreum) string {
+	switch cr.Spec.Mode {
+	case modeMaintenance:
+		return "Horreum and Keycloak are stopped for maintenance, the database is running"
+	case modeStopped:
+		return "All components are stopped"
+	}
+	return ""
+}
@@ -0,0 +1,232 @@
+package horreum
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	logr "github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Prometheus Operator types are not part of the scheme as the API is optional
+var serviceMonitorKind = schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "ServiceMonitor"}
+var prometheusRuleKind = schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "PrometheusRule"}
+
+func newUnstructured(gvk schema.GroupVersionKind) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(gvk)
+	return u
+}
+
+func monitoringEnabled(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) bool {
+	return cr.Spec.Monitoring.Enabled && r.MonitoringAvailable
+}
+
+func monitoringLabels(cr *hyperfoilv1alpha1.Horreum) map[string]string {
+	labels := map[string]string{}
+	for key, value := range cr.Spec.Monitoring.Labels {
+		labels[key] = value
+	}
+	labels["app"] = cr.Name
+	return labels
+}
+
+func ensureMonitoring(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger,
+	appService *corev1.Service, keycloakService *corev1.Service) error {
+	if !r.MonitoringAvailable {
+		if cr.Spec.Monitoring.Enabled {
+			logger.Info("Monitoring is enabled but monitoring.coreos.com API is not available, ignoring.")
+		}
+		return nil
+	}
+	serviceMonitor := serviceMonitor(cr)
+	prometheusRule := prometheusRule(cr)
+	if !cr.Spec.Monitoring.Enabled {
+		certificateExpiryThreshold.DeleteLabelValues(cr.Namespace, cr.Name)
+		if err := ensureDeleted(r, cr, serviceMonitor, newUnstructured(serviceMonitorKind)); err != nil {
+			return err
+		}
+		return ensureDeleted(r, cr, prometheusRule, newUnstructured(prometheusRuleKind))
+	}
+	// Services created by previous versions of the operator don't have the labels; we don't want
+	// to recreate them as that could change the node port or load balancer address.
+	services := []*corev1.Service{appService}
+	if keycloakDeployed(cr) {
+		services = append(services, keycloakService)
+	}
+	for _, service := range services {
+		if err := ensureLabels(r, service); err != nil {
+			return err
+		}
+	}
+	certificateExpiryDays := int32(14)
+	if cr.Spec.Monitoring.CertificateExpiryDays != nil {
+		certificateExpiryDays = *cr.Spec.Monitoring.CertificateExpiryDays
+	}
+	certificateExpiryThreshold.WithLabelValues(cr.Namespace, cr.Name).Set(float64(certificateExpiryDays))
+	if err := ensureSame(r, cr, logger, serviceMonitor, newUnstructured(serviceMonitorKind), compareUnstructuredSpec, nocheck); err != nil {
+		return err
+	}
+	return ensureSame(r, cr, logger, prometheusRule, newUnstructured(prometheusRuleKind), compareUnstructuredSpec, nocheck)
+}
+
+func ensureLabels(r *HorreumReconciler, service *corev1.Service) error {
+	found := &corev1.Service{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: service.Name, Namespace: service.Namespace}, found); err != nil {
+		return err
+	}
+	patch := client.MergeFrom(found.DeepCopy())
+	missing := false
+	for key, value := range service.Labels {
+		if found.Labels[key] != value {
+			if found.Labels == nil {
+				found.Labels = map[string]string{}
+			}
+			found.Labels[key] = value
+			missing = true
+		}
+	}
+	if !missing {
+		return nil
+	}
+	return r.Patch(context.TODO(), found, patch)
+}
+
+func serviceMonitor(cr *hyperfoilv1alpha1.Horreum) *unstructured.Unstructured {
+	endpoints := []interface{}{
+		metricsEndpoint(cr, "app", strings.TrimSuffix(innerProtocol(cr.Spec.Route), "://"), "/q/metrics", cr.Name),
+	}
+	if keycloakDeployed(cr) {
+		endpoints = append(endpoints, metricsEndpoint(cr, "keycloak", "https", "/metrics", cr.Name+"-keycloak"))
+	}
+	u := newUnstructured(serviceMonitorKind)
+	u.SetName(cr.Name)
+	u.SetNamespace(cr.Namespace)
+	u.SetLabels(monitoringLabels(cr))
+	u.Object["spec"] = map[string]interface{}{
+		"selector": map[string]interface{}{
+			"matchLabels": map[string]interface{}{
+				"app": cr.Name,
+			},
+		},
+		"endpoints": endpoints,
+	}
+	return u
+}
+
+// metricsEndpoint scrapes only the service with given label; the port is matched by name
+func metricsEndpoint(cr *hyperfoilv1alpha1.Horreum, service string, scheme string, path string, serviceName string) map[string]interface{} {
+	endpoint := map[string]interface{}{
+		"port":   scheme,
+		"scheme": scheme,
+		"path":   path,
+		"relabelings": []interface{}{
+			map[string]interface{}{
+				"action":       "keep",
+				"sourceLabels": []interface{}{"__meta_kubernetes_service_label_service"},
+				"regex":        service,
+			},
+		},
+	}
+	if cr.Spec.Monitoring.Interval != "" {
+		endpoint["interval"] = cr.Spec.Monitoring.Interval
+	}
+	if scheme == "https" {
+		endpoint["tlsConfig"] = map[string]interface{}{
+			"serverName": serviceName + "." + cr.Namespace + ".svc",
+			"ca": map[string]interface{}{
+				"configMap": map[string]interface{}{
+					"name": "service-ca.crt",
+					"key":  "service-ca.crt",
+				},
+			},
+		}
+	}
+	return endpoint
+}
+
+// prometheusRule alerts on metrics of targets scraped for this instance and of kube-state-metrics and kubelet;
+// Prometheus for user workloads enforces the namespace of the rule on all series, so metrics of the operator
+// (e.g. certificate expiry) are covered by rules installed with the operator.
+func prometheusRule(cr *hyperfoilv1alpha1.Horreum) *unstructured.Unstructured {
+	// Components stopped by spec.mode are not alerted on
+	rules := []interface{}{}
+	if !appStopped(cr) {
+		rules = append(rules, alert("HorreumAppDown",
+			fmt.Sprintf(`absent(up{namespace="%s",service="%s"} == 1)`, cr.Namespace, cr.Name), "5m", "critical",
+			"Horreum "+cr.Namespace+"/"+cr.Name+" has no running application instance."))
+	}
+	if keycloakDeployed(cr) && !appStopped(cr) {
+		rules = append(rules, alert("HorreumKeycloakDown",
+			fmt.Sprintf(`absent(up{namespace="%s",service="%s-keycloak"} == 1)`, cr.Namespace, cr.Name), "5m", "critical",
+			"Keycloak of Horreum "+cr.Namespace+"/"+cr.Name+" is not running."))
+	}
+	if postgresDeployed(cr) && cr.Spec.Mode != modeStopped {
+		rules = append(rules, alert("HorreumDatabaseDown",
+			fmt.Sprintf(`kube_pod_status_ready{namespace="%s",pod="%s-db",condition="true"} == 0`, cr.Namespace, cr.Name), "5m", "critical",
+			"PostgreSQL of Horreum "+cr.Namespace+"/"+cr.Name+" is not ready."))
+	}
+	if postgresDeployed(cr) && cr.Spec.Postgres.PersistentVolumeClaim != "" {
+		diskFreePercentage := int32(10)
+		if cr.Spec.Monitoring.DiskFreePercentage != nil {
+			diskFreePercentage = *cr.Spec.Monitoring.DiskFreePercentage
+		}
+		volume := fmt.Sprintf(`namespace="%s",persistentvolumeclaim="%s"`, cr.Namespace, cr.Spec.Postgres.PersistentVolumeClaim)
+		rules = append(rules, alert("HorreumDatabaseDiskFilling",
+			fmt.Sprintf("100 * kubelet_volume_stats_available_bytes{%s} / kubelet_volume_stats_capacity_bytes{%s} < %d",
+				volume, volume, diskFreePercentage), "5m", "warning",
+			"Database volume "+cr.Spec.Postgres.PersistentVolumeClaim+" has only {{ $value | humanize }}% free space."))
+	}
+	u := newUnstructured(prometheusRuleKind)
+	u.SetName(cr.Name)
+	u.SetNamespace(cr.Namespace)
+	u.SetLabels(monitoringLabels(cr))
+	u.Object["spec"] = map[string]interface{}{
+		"groups": []interface{}{
+			map[string]interface{}{
+				"name":  "horreum-" + cr.Name,
+				"rules": rules,
+			},
+		},
+	}
+	return u
+}
+
+func alert(name string, expr string, duration string, severity string, description string) map[string]interface{} {
+	return map[string]interface{}{
+		"alert": name,
+		"expr":  expr,
+		"for":   duration,
+		"labels": map[string]interface{}{
+			"severity": severity,
+		},
+		"annotations": map[string]interface{}{
+			"description": description,
+		},
+	}
+}
+
+func compareUnstructuredSpec(i1 interface{}, i2 interface{}, logger logr.Logger) bool {
+	u1, ok1 := i1.(*unstructured.Unstructured)
+	u2, ok2 := i2.(*unstructured.Unstructured)
+	if !ok1 || !ok2 {
+		logger.Info("Cannot cast to Unstructured: " + fmt.Sprintf("%v | %v", i1, i2))
+		return false
+	}
+	if !equality.Semantic.DeepDerivative(u1.GetLabels(), u2.GetLabels()) {
+		logger.Info("Labels don't match: " + fmt.Sprintf("%v | %v", u1.GetLabels(), u2.GetLabels()))
+		return false
+	}
+	if !equality.Semantic.DeepDerivative(u1.Object["spec"], u2.Object["spec"]) {
+		logger.Info("Spec does not match: " + fmt.Sprintf("%v | %v", u1.Object["spec"], u2.Object["spec"]))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,206 @@
+package horreum
+
+import (
+	"context"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	logr "github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// Label OpenShift sets on namespaces of the router and cluster monitoring
+const policyGroupLabel = "network.openshift.io/policy-group"
+
+// ensureNetworkPolicies restricts ingress to each component; policies of components that are not deployed are removed
+func ensureNetworkPolicies(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger) error {
+	appPolicy := networkPolicy(cr, "app", nil)
+	keycloakPolicy := networkPolicy(cr, "keycloak", nil)
+	dbPolicy := networkPolicy(cr, "db", nil)
+	spec := cr.Spec.NetworkPolicy
+	if spec == nil {
+		for _, policy := range []*networkingv1.NetworkPolicy{appPolicy, keycloakPolicy, dbPolicy} {
+			if err := ensureDeleted(r, cr, policy, &networkingv1.NetworkPolicy{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	keycloakConsumers, postgresConsumers, err := sharedConsumers(r, cr)
+	if err != nil {
+		return err
+	}
+	monitoring := []networkingv1.NetworkPolicyPeer{}
+	if cr.Spec.Monitoring.Enabled && r.MonitoringAvailable && r.OpenShift {
+		monitoring = append(monitoring, namespaceGroupPeer("monitoring"))
+	}
+
+	appPeers := []networkingv1.NetworkPolicyPeer{instancePeer(cr, "app")}
+	appPeers = append(appPeers, monitoring...)
+	appPeers = append(appPeers, spec.App...)
+	appPolicy = networkPolicy(cr, "app", ingressRules(r, cr, cr.Spec.ServiceType, appPeers))
+	if err := ensureUpdated(r, cr, logger, appPolicy, &networkingv1.NetworkPolicy{}, compareNetworkPolicies, nocheck); err != nil {
+		return err
+	}
+
+	if keycloakDeployed(cr) {
+		keycloakPeers := []networkingv1.NetworkPolicyPeer{instancePeer(cr, "app")}
+		keycloakPeers = append(keycloakPeers, monitoring...)
+		keycloakPeers = append(keycloakPeers, keycloakConsumers...)
+		if len(keycloakConsumers) > 0 && r.OperatorNamespace != "" {
+			// The operator provisions realms through the admin API
+			keycloakPeers = append(keycloakPeers, networkingv1.NetworkPolicyPeer{
+				NamespaceSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{
+						"kubernetes.io/metadata.name": r.OperatorNamespace,
+					},
+				},
+				PodSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{
+						"control-plane": "controller-manager",
+					},
+				},
+			})
+		}
+		keycloakPeers = append(keycloakPeers, spec.Keycloak...)
+		keycloakPolicy = networkPolicy(cr, "keycloak", ingressRules(r, cr, cr.Spec.Keycloak.ServiceType, keycloakPeers))
+		if err := ensureUpdated(r, cr, logger, keycloakPolicy, &networkingv1.NetworkPolicy{}, compareNetworkPolicies, nocheck); err != nil {
+			return err
+		}
+	} else if err := ensureDeleted(r, cr, keycloakPolicy, &networkingv1.NetworkPolicy{}); err != nil {
+		return err
+	}
+
+	if postgresDeployed(cr) {
+		// Jobs of resources using shared PostgreSQL run in this namespace
+		dbPeers := []networkingv1.NetworkPolicyPeer{instancePeer(cr, "app", "keycloak", "db-job")}
+		dbPeers = append(dbPeers, postgresConsumers...)
+		dbPeers = append(dbPeers, spec.Database...)
+		dbPolicy = networkPolicy(cr, "db", []networkingv1.NetworkPolicyIngressRule{{From: dbPeers}})
+		if err := ensureUpdated(r, cr, logger, dbPolicy, &networkingv1.NetworkPolicy{}, compareNetworkPolicies, nocheck); err != nil {
+			return err
+		}
+	} else if err := ensureDeleted(r, cr, dbPolicy, &networkingv1.NetworkPolicy{}); err != nil {
+		return err
+	}
+	return nil
+}
+
+func networkPolicy(cr *hyperfoilv1alpha1.Horreum, service string, rules []networkingv1.NetworkPolicyIngressRule) *networkingv1.NetworkPolicy {
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.Name + "-" + service,
+			Namespace: cr.Namespace,
+			Labels: map[string]string{
+				"app": cr.Name,
+			},
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app":     cr.Name,
+					"service": service,
+				},
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress:     rules,
+		},
+	}
+}
+
+// ingressRules adds the path through which the service is exposed to the peers. NodePort and LoadBalancer services
+// receive connections from outside of the cluster, as well as services behind an unknown ingress controller,
+// so these accept connections from any source.
+func ingressRules(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, serviceType corev1.ServiceType,
+	peers []networkingv1.NetworkPolicyPeer) []networkingv1.NetworkPolicyIngressRule {
+	if ingress := cr.Spec.NetworkPolicy.Ingress; len(ingress) > 0 {
+		return []networkingv1.NetworkPolicyIngressRule{{From: append(peers, ingress...)}}
+	}
+	if isNodePort(r, serviceType) || serviceType == corev1.ServiceTypeLoadBalancer || !r.useRoutes() {
+		return []networkingv1.NetworkPolicyIngressRule{{}}
+	}
+	return []networkingv1.NetworkPolicyIngressRule{{From: append(peers, namespaceGroupPeer("ingress"))}}
+}
+
+// instancePeer selects pods of given services of this resource
+func instancePeer(cr *hyperfoilv1alpha1.Horreum, services ...string) networkingv1.NetworkPolicyPeer {
+	return networkingv1.NetworkPolicyPeer{
+		PodSelector: &metav1.LabelSelector{
+			MatchLabels: map[string]string{
+				"app": cr.Name,
+			},
+			MatchExpressions: []metav1.LabelSelectorRequirement{
+				{
+					Key:      "service",
+					Operator: metav1.LabelSelectorOpIn,
+					Values:   services,
+				},
+			},
+		},
+	}
+}
+
+func namespaceGroupPeer(group string) networkingv1.NetworkPolicyPeer {
+	return networkingv1.NetworkPolicyPeer{
+		NamespaceSelector: &metav1.LabelSelector{
+			MatchLabels: map[string]string{
+				policyGroupLabel: group,
+			},
+		},
+	}
+}
+
+// sharedConsumers returns peers selecting pods of resources using Keycloak and PostgreSQL of this resource
+func sharedConsumers(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum) ([]networkingv1.NetworkPolicyPeer, []networkingv1.NetworkPolicyPeer, error) {
+	list := &hyperfoilv1alpha1.HorreumList{}
+	if err := r.List(context.TODO(), list); err != nil {
+		return nil, nil, err
+	}
+	name := types.NamespacedName{Name: cr.Name, Namespace: cr.Namespace}
+	keycloak := []networkingv1.NetworkPolicyPeer{}
+	postgres := []networkingv1.NetworkPolicyPeer{}
+	for _, consumer := range list.Items {
+		peer := networkingv1.NetworkPolicyPeer{
+			NamespaceSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"kubernetes.io/metadata.name": consumer.Namespace,
+				},
+			},
+			PodSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app": consumer.Name,
+				},
+			},
+		}
+		if consumer.Spec.Keycloak.Shared != nil && sharedKeycloakProviderName(&consumer) == name &&
+			sharingPermitted(&consumer, cr, cr.Spec.Keycloak.SharedNamespaces) {
+			keycloak = append(keycloak, peer)
+		}
+		if consumer.Spec.Postgres.Shared != nil && consumer.Spec.Postgres.Shared.Horreum != "" &&
+			sharedPostgresProviderName(&consumer) == name && sharingPermitted(&consumer, cr, cr.Spec.Postgres.SharedNamespaces) {
+			postgres = append(postgres, peer)
+		}
+	}
+	return keycloak, postgres, nil
+}
+
+// findSharedProviders maps Horreum resource to resources deploying Keycloak or PostgreSQL it uses,
+// so that their network policies admit the consumer
+func (r *HorreumReconciler) findSharedProviders(obj client.Object) []reconcile.Request {
+	cr, ok := obj.(*hyperfoilv1alpha1.Horreum)
+	if !ok {
+		return nil
+	}
+	requests := []reconcile.Request{}
+	if cr.Spec.Keycloak.Shared != nil {
+		requests = append(requests, reconcile.Request{NamespacedName: sharedKeycloakProviderName(cr)})
+	}
+	if cr.Spec.Postgres.Shared != nil && cr.Spec.Postgres.Shared.Horreum != "" {
+		requests = append(requests, reconcile.Request{NamespacedName: sharedPostgresProviderName(cr)})
+	}
+	return requests
+}
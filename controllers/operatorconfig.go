@@ -0,0 +1,91 @@
+package horreum
+
+import (
+	"context"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	certificateProviderOperator  = "operator"
+	certificateProviderServiceCA = "service-ca"
+)
+
+// forReconcile returns a copy of the reconciler holding cluster-wide configuration and mirrors read at the start
+// of the reconciliation; changes in the configuration apply without restarting the operator.
+func (r *HorreumReconciler) forReconcile() *HorreumReconciler {
+	snapshot := *r
+	snapshot.config = r.readOperatorConfig()
+	if r.MirrorPoliciesAvailable {
+		snapshot.policyMirrors = r.imageContentSourceMirrors()
+	}
+	return &snapshot
+}
+
+// operatorConfig returns configuration read for this reconciliation, or reads it when used outside of it
+func (r *HorreumReconciler) operatorConfig() *hyperfoilv1alpha1.HorreumOperatorConfigSpec {
+	if r.config != nil {
+		return r.config
+	}
+	return r.readOperatorConfig()
+}
+
+// readOperatorConfig reads cluster-wide defaults; missing configuration results in empty defaults.
+func (r *HorreumReconciler) readOperatorConfig() *hyperfoilv1alpha1.HorreumOperatorConfigSpec {
+	config := &hyperfoilv1alpha1.HorreumOperatorConfig{}
+	err := r.clusterReader().Get(context.TODO(), types.NamespacedName{Name: hyperfoilv1alpha1.OperatorConfigName}, config)
+	if err != nil && !errors.IsNotFound(err) {
+		r.logClusterReadError(err, "HorreumOperatorConfig")
+		return &hyperfoilv1alpha1.HorreumOperatorConfigSpec{}
+	}
+	return &config.Spec
+}
+
+// useRoutes returns true when services should be exposed through OpenShift routes
+func (r *HorreumReconciler) useRoutes() bool {
+	routes := r.operatorConfig().Platform.Routes
+	return r.RoutesAvailable && (routes == nil || *routes)
+}
+
+func (r *HorreumReconciler) certificateProvider() string {
+	if provider := r.operatorConfig().CertificateProvider; provider != "" {
+		return provider
+	}
+	return ifThenElse(r.RoutesAvailable, certificateProviderServiceCA, certificateProviderOperator)
+}
+
+func (r *HorreumReconciler) watchesNamespace(namespace string) bool {
+	namespaces := r.operatorConfig().WatchNamespaces
+	if len(namespaces) == 0 {
+		return true
+	}
+	for _, ns := range namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// findAllHorreums maps a change in operator configuration to all Horreum resources
+func (r *HorreumReconciler) findAllHorreums(obj client.Object) []reconcile.Request {
+	if obj.GetName() != hyperfoilv1alpha1.OperatorConfigName {
+		return nil
+	}
+	list := &hyperfoilv1alpha1.HorreumList{}
+	if err := r.List(context.TODO(), list); err != nil {
+		r.Log.Error(err, "Cannot list Horreum resources")
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, cr := range list.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Name: cr.Name, Namespace: cr.Namespace},
+		})
+	}
+	return requests
+}
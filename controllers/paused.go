@@ -0,0 +1,83 @@
+package horreum
+
+import (
+	"context"
+	"strings"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	logr "github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const conditionPaused = "Paused"
+
+// refreshPausedStatus only observes the components and updates status; nothing is created or deleted
+func refreshPausedStatus(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger) error {
+	logger.Info("Reconciliation is paused, only refreshing status")
+	meta.SetStatusCondition(&cr.Status.Conditions, metav1.Condition{
+		Type:               conditionPaused,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: cr.Generation,
+		Reason:             "PausedBySpec",
+		Message:            "spec.paused is set; the operator does not apply any changes",
+	})
+	notReady := []string{}
+	observe := func(component string, object client.Object, check checkFunc) error {
+		err := r.Get(context.TODO(), types.NamespacedName{Name: object.GetName(), Namespace: cr.Namespace}, object)
+		if err != nil && errors.IsNotFound(err) {
+			recordComponentReady(cr, component, false)
+			notReady = append(notReady, component+" is missing")
+			return nil
+		} else if err != nil {
+			return err
+		}
+		ok, _, reason := check(object)
+		recordComponentReady(cr, component, ok)
+		if !ok {
+			notReady = append(notReady, component+reason)
+		}
+		return nil
+	}
+	if postgresDeployed(cr) {
+		if err := observe("db", &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: cr.Name + "-db"}}, checkPod); err != nil {
+			return err
+		}
+	}
+	if keycloakDeployed(cr) {
+		if err := observe("keycloak", &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: cr.Name + "-keycloak"}}, checkPod); err != nil {
+			return err
+		}
+	}
+	if err := observe("app", &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: cr.Name + "-app"}}, checkDeployment); err != nil {
+		return err
+	}
+	reason := "Reconciliation is paused"
+	if !cr.DeletionTimestamp.IsZero() {
+		reason += "; deletion waits until it is resumed"
+	}
+	if len(notReady) > 0 {
+		reason += "; " + strings.Join(notReady, ", ")
+	}
+	if cr.Status.Status != "Paused" || cr.Status.Reason != reason {
+		setStatus(r, cr, "Paused", reason)
+	}
+	return r.Status().Update(context.TODO(), cr)
+}
+
+func setResumed(cr *hyperfoilv1alpha1.Horreum) {
+	if meta.IsStatusConditionTrue(cr.Status.Conditions, conditionPaused) {
+		meta.SetStatusCondition(&cr.Status.Conditions, metav1.Condition{
+			Type:               conditionPaused,
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: cr.Generation,
+			Reason:             "Resumed",
+			Message:            "Reconciliation has been resumed",
+		})
+	}
+}
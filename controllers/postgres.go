@@ -2,7 +2,6 @@ package horreum
 
 import (
 	"fmt"
-	"strings"
 
 	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
@@ -11,7 +10,7 @@ import (
 )
 
 func postgresConfigMap(cr *hyperfoilv1alpha1.Horreum) *corev1.ConfigMap {
-	keycloakDbName := withDefault(cr.Spec.Keycloak.Database.Name, "keycloak")
+	keycloakDbName := keycloakDatabaseName(cr)
 	return &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      cr.Name + "-postgresql-start",
@@ -64,7 +63,9 @@ func postgresPod(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) *corev1.Po
 			EmptyDir: &corev1.EmptyDirVolumeSource{},
 		}
 	}
-	image := dbImage(cr, r.UseRedHatImages)
+	profile := dbImageProfile(cr, r)
+	image := dbImage(cr, r, profile)
+	resources := withDefaultResources(cr.Spec.Postgres.Resources, r.operatorConfig().Resources.Postgres)
 	envs := []corev1.EnvVar{
 		secretEnv("KEYCLOAK_USER", keycloakDbSecret(cr), corev1.BasicAuthUsernameKey),
 		secretEnv("KEYCLOAK_PASSWORD", keycloakDbSecret(cr), corev1.BasicAuthPasswordKey),
@@ -72,64 +73,59 @@ func postgresPod(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) *corev1.Po
 		secretEnv("APP_PASSWORD", appUserSecret(cr), corev1.BasicAuthPasswordKey),
 		secretEnv("APP_DB_SECRET", appUserSecret(cr), "dbsecret"),
 	}
+	envs = append(envs, profile.env(cr)...)
 
-	var userId int64
-	var initDir string
-	if strings.HasPrefix(image, "docker.io/library/postgres") || strings.HasPrefix(image, "postgres") {
-		userId = int64(999)
-		initDir = "/docker-entrypoint-initdb.d/"
-		envs = append(envs,
-			corev1.EnvVar{
-				Name:  "POSTGRES_DB",
-				Value: withDefault(cr.Spec.Database.Name, "horreum"),
-			},
-			corev1.EnvVar{
-				Name:  "PGDATABASE",
-				Value: withDefault(cr.Spec.Database.Name, "horreum"),
-			},
-			corev1.EnvVar{
-				Name:  "PGDATA",
-				Value: "/var/lib/pgsql/data",
-			},
-			secretEnv("PGUSER", dbAdminSecret(cr), corev1.BasicAuthUsernameKey),
-			secretEnv("POSTGRES_USER", dbAdminSecret(cr), corev1.BasicAuthUsernameKey),
-			// because of the init script
-			secretEnv("POSTGRESQL_USER", dbAdminSecret(cr), corev1.BasicAuthUsernameKey),
-			secretEnv("POSTGRES_PASSWORD", dbAdminSecret(cr), corev1.BasicAuthPasswordKey),
-		)
-	} else { // Red Hat image
-		userId = int64(26)
-		initDir = "/opt/app-root/src/postgresql-start"
-		envs = append(envs,
-			corev1.EnvVar{
-				Name:  "POSTGRESQL_DATABASE",
-				Value: withDefault(cr.Spec.Database.Name, "horreum"),
-			},
-			secretEnv("POSTGRESQL_USER", dbAdminSecret(cr), corev1.BasicAuthUsernameKey),
-			secretEnv("POSTGRESQL_PASSWORD", dbAdminSecret(cr), corev1.BasicAuthPasswordKey))
-	}
-
+	userId := profile.uid
 	if cr.Spec.Postgres.User != nil {
 		userId = *cr.Spec.Postgres.User
 	}
 	initContainers := []corev1.Container{}
-	if !r.UseRedHatImages {
+	// Restricted security context on OpenShift does not permit running as root
+	if profile.chownDataDir && !r.OpenShift {
 		initContainers = append(initContainers, corev1.Container{
 			Name:    "init",
-			Image:   image,
-			Command: []string{"chown", fmt.Sprint(userId), "/var/lib/pgsql/data"},
+			Image:   r.mirrorImage(image),
+			Command: []string{"chown", fmt.Sprint(userId), profile.dataDir},
 			SecurityContext: &corev1.SecurityContext{
 				RunAsUser: &[]int64{0}[0],
 			},
 			VolumeMounts: []corev1.VolumeMount{
 				{
 					Name:      "db-volume",
-					MountPath: "/var/lib/pgsql/data",
+					MountPath: profile.dataDir,
 				},
 			},
+			Resources: resources,
 		})
 	}
-	return &corev1.Pod{
+	isReady := []string{"pg_isready", "-h", "127.0.0.1", "-p", "5432"}
+	volumeMounts := []corev1.VolumeMount{
+		{
+			Name:      "db-volume",
+			MountPath: profile.dataDir,
+		},
+		{
+			Name:      "postgresql-start",
+			MountPath: profile.initDir,
+		},
+	}
+	volumes := []corev1.Volume{
+		{
+			Name:         "db-volume",
+			VolumeSource: dbVolumeSrc,
+		},
+		{
+			Name: "postgresql-start",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: cr.Name + "-postgresql-start",
+					},
+				},
+			},
+		},
+	}
+	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      cr.Name + "-db",
 			Namespace: cr.Namespace,
@@ -143,7 +139,7 @@ func postgresPod(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) *corev1.Po
 			Containers: []corev1.Container{
 				{
 					Name:  "postgres",
-					Image: image,
+					Image: r.mirrorImage(image),
 					Env:   envs,
 					Ports: []corev1.ContainerPort{
 						{
@@ -154,36 +150,20 @@ func postgresPod(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) *corev1.Po
 					SecurityContext: &corev1.SecurityContext{
 						RunAsUser: &[]int64{userId}[0],
 					},
-					VolumeMounts: []corev1.VolumeMount{
-						{
-							Name:      "db-volume",
-							MountPath: "/var/lib/pgsql/data",
-						},
-						{
-							Name:      "postgresql-start",
-							MountPath: initDir,
-						},
-					},
-				},
-			},
-			Volumes: []corev1.Volume{
-				{
-					Name:         "db-volume",
-					VolumeSource: dbVolumeSrc,
-				},
-				{
-					Name: "postgresql-start",
-					VolumeSource: corev1.VolumeSource{
-						ConfigMap: &corev1.ConfigMapVolumeSource{
-							LocalObjectReference: corev1.LocalObjectReference{
-								Name: cr.Name + "-postgresql-start",
-							},
-						},
-					},
+					VolumeMounts: volumeMounts,
+					Resources:    resources,
+					// Initialization scripts run before the server starts listening on TCP
+					StartupProbe:   withDefaultProbe(cr.Spec.Postgres.Probes.Startup, execProbe(isReady, 5, 60)),
+					LivenessProbe:  withDefaultProbe(cr.Spec.Postgres.Probes.Liveness, execProbe(isReady, 10, 6)),
+					ReadinessProbe: withDefaultProbe(cr.Spec.Postgres.Probes.Readiness, execProbe(isReady, 10, 3)),
 				},
 			},
+			Volumes: volumes,
 		},
 	}
+	applyScheduling(&pod.Spec, &cr.Spec.Postgres.SchedulingSpec)
+	applyCustomization(pod, &cr.Spec.Postgres.PodCustomizationSpec)
+	return pod
 }
 
 func postgresService(cr *hyperfoilv1alpha1.Horreum) *corev1.Service {
@@ -0,0 +1,188 @@
+package horreum
+
+import (
+	"sort"
+	"strings"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Image profiles supported for the PostgreSQL database
+const (
+	imageProfileUpstream = "upstream"
+	imageProfileRedHat   = "redhat"
+	imageProfileBitnami  = "bitnami"
+)
+
+// imageProfile describes how a family of PostgreSQL images is configured
+type imageProfile struct {
+	// Image used when spec.postgres.image is not set
+	image string
+	// Fragments of repository names identifying images of this profile
+	repositories []string
+	// User the server runs as (unless overridden in spec.postgres.user)
+	uid int64
+	// Directory the database volume is mounted to
+	dataDir string
+	// Directory where the image picks up initialization scripts
+	initDir string
+	// True when the data directory must be owned by the user before the server starts
+	chownDataDir bool
+	// Returns environment variables setting up the database, admin user and local psql access;
+	// the initialization scripts expect POSTGRESQL_USER to hold name of the admin user
+	env func(cr *hyperfoilv1alpha1.Horreum) []corev1.EnvVar
+}
+
+var imageProfiles = map[string]imageProfile{
+	imageProfileUpstream: {
+		image:        "docker.io/library/postgres:14.4",
+		repositories: []string{"library/postgres"},
+		uid:          999,
+		dataDir:      "/var/lib/pgsql/data",
+		initDir:      "/docker-entrypoint-initdb.d/",
+		chownDataDir: true,
+		env: func(cr *hyperfoilv1alpha1.Horreum) []corev1.EnvVar {
+			return []corev1.EnvVar{
+				{
+					Name:  "POSTGRES_DB",
+					Value: databaseName(cr),
+				},
+				{
+					Name:  "PGDATABASE",
+					Value: databaseName(cr),
+				},
+				{
+					Name:  "PGDATA",
+					Value: "/var/lib/pgsql/data",
+				},
+				secretEnv("PGUSER", dbAdminSecret(cr), corev1.BasicAuthUsernameKey),
+				secretEnv("POSTGRES_USER", dbAdminSecret(cr), corev1.BasicAuthUsernameKey),
+				secretEnv("POSTGRESQL_USER", dbAdminSecret(cr), corev1.BasicAuthUsernameKey),
+				secretEnv("POSTGRES_PASSWORD", dbAdminSecret(cr), corev1.BasicAuthPasswordKey),
+			}
+		},
+	},
+	imageProfileRedHat: {
+		image:        "registry.redhat.io/rhel8/postgresql-12:latest",
+		repositories: []string{"registry.redhat.io/rhel", "registry.access.redhat.com/rhel", "sclorg/postgresql", "centos/postgresql"},
+		uid:          26,
+		dataDir:      "/var/lib/pgsql/data",
+		initDir:      "/opt/app-root/src/postgresql-start",
+		env: func(cr *hyperfoilv1alpha1.Horreum) []corev1.EnvVar {
+			return []corev1.EnvVar{
+				{
+					Name:  "POSTGRESQL_DATABASE",
+					Value: databaseName(cr),
+				},
+				secretEnv("POSTGRESQL_USER", dbAdminSecret(cr), corev1.BasicAuthUsernameKey),
+				secretEnv("POSTGRESQL_PASSWORD", dbAdminSecret(cr), corev1.BasicAuthPasswordKey),
+			}
+		},
+	},
+	imageProfileBitnami: {
+		image:        "docker.io/bitnami/postgresql:14",
+		repositories: []string{"bitnami/postgresql"},
+		uid:          1001,
+		dataDir:      "/bitnami/postgresql",
+		initDir:      "/docker-entrypoint-initdb.d/",
+		env: func(cr *hyperfoilv1alpha1.Horreum) []corev1.EnvVar {
+			// Bitnami creates the admin user without superuser privileges; the scripts run as postgres
+			return []corev1.EnvVar{
+				{
+					Name:  "POSTGRESQL_DATABASE",
+					Value: databaseName(cr),
+				},
+				{
+					Name:  "PGDATABASE",
+					Value: databaseName(cr),
+				},
+				{
+					Name:  "PGUSER",
+					Value: "postgres",
+				},
+				secretEnv("POSTGRESQL_USERNAME", dbAdminSecret(cr), corev1.BasicAuthUsernameKey),
+				secretEnv("POSTGRESQL_USER", dbAdminSecret(cr), corev1.BasicAuthUsernameKey),
+				secretEnv("POSTGRESQL_PASSWORD", dbAdminSecret(cr), corev1.BasicAuthPasswordKey),
+				secretEnv("POSTGRESQL_POSTGRES_PASSWORD", dbAdminSecret(cr), corev1.BasicAuthPasswordKey),
+				secretEnv("PGPASSWORD", dbAdminSecret(cr), corev1.BasicAuthPasswordKey),
+			}
+		},
+	},
+}
+
+// Databases on shared server are named after the resource to avoid collisions
+// databaseName on shared PostgreSQL is prefixed with the namespace, as databases are shared by all tenants
+func databaseName(cr *hyperfoilv1alpha1.Horreum) string {
+	if cr.Spec.Postgres.Shared != nil {
+		return cr.Namespace + "-" + withDefault(cr.Spec.Database.Name, cr.Name)
+	}
+	return withDefault(cr.Spec.Database.Name, "horreum")
+}
+
+func keycloakDatabaseName(cr *hyperfoilv1alpha1.Horreum) string {
+	if cr.Spec.Postgres.Shared != nil {
+		return cr.Namespace + "-" + withDefault(cr.Spec.Keycloak.Database.Name, cr.Name+"-keycloak")
+	}
+	return withDefault(cr.Spec.Keycloak.Database.Name, "keycloak")
+}
+
+// dbImageProfile selects the profile set in spec, the one matching a custom image, the defaults
+// from operator configuration and command line, or the platform default, in this order.
+// Images are matched before mirroring, so mirrored registries do not affect the detection.
+func dbImageProfile(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) imageProfile {
+	config := r.operatorConfig()
+	candidates := []string{
+		cr.Spec.Postgres.ImageProfile,
+		profileOfImage(cr.Spec.Postgres.Image),
+		config.Images.PostgresProfile,
+		profileOfImage(config.Images.Postgres),
+		r.DefaultImageProfile,
+	}
+	for _, name := range candidates {
+		if profile, ok := imageProfiles[name]; ok {
+			return profile
+		}
+	}
+	return imageProfiles[ifThenElse(r.OpenShift, imageProfileRedHat, imageProfileUpstream)]
+}
+
+// dbImage uses default image from operator configuration unless the resource selects a different profile
+func dbImage(cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler, profile imageProfile) string {
+	if cr.Spec.Postgres.Image != "" {
+		return cr.Spec.Postgres.Image
+	}
+	if image := r.operatorConfig().Images.Postgres; image != "" && cr.Spec.Postgres.ImageProfile == "" {
+		return image
+	}
+	return profile.image
+}
+
+func profileOfImage(image string) string {
+	if image == "" {
+		return ""
+	}
+	// Images from Docker Hub may be referenced without the registry, e.g. `postgres:14`
+	if strings.HasPrefix(image, "postgres:") || strings.HasPrefix(image, "postgres@") || image == "postgres" {
+		return imageProfileUpstream
+	}
+	names := make([]string, 0, len(imageProfiles))
+	for name := range imageProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, repository := range imageProfiles[name].repositories {
+			if strings.Contains(image, repository) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// IsImageProfile returns true if the name is one of the supported database image profiles
+func IsImageProfile(name string) bool {
+	_, ok := imageProfiles[name]
+	return ok
+}
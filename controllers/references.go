@@ -0,0 +1,264 @@
+package horreum
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const referencesHashAnnotation = "hyperfoil.io/references-hash"
+
+// referencedObjects lists names of secrets and config maps used by the pod in environment variables or volumes
+func referencedObjects(spec *corev1.PodSpec) (secrets []string, configMaps []string) {
+	secretSet := map[string]bool{}
+	configMapSet := map[string]bool{}
+	containers := append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, c := range containers {
+		for _, env := range c.Env {
+			if env.ValueFrom == nil {
+				continue
+			}
+			if env.ValueFrom.SecretKeyRef != nil {
+				secretSet[env.ValueFrom.SecretKeyRef.Name] = true
+			}
+			if env.ValueFrom.ConfigMapKeyRef != nil {
+				configMapSet[env.ValueFrom.ConfigMapKeyRef.Name] = true
+			}
+		}
+		for _, envFrom := range c.EnvFrom {
+			if envFrom.SecretRef != nil {
+				secretSet[envFrom.SecretRef.Name] = true
+			}
+			if envFrom.ConfigMapRef != nil {
+				configMapSet[envFrom.ConfigMapRef.Name] = true
+			}
+		}
+	}
+	for _, v := range spec.Volumes {
+		if v.Secret != nil {
+			secretSet[v.Secret.SecretName] = true
+		}
+		if v.ConfigMap != nil {
+			configMapSet[v.ConfigMap.Name] = true
+		}
+		if v.Projected != nil {
+			for _, source := range v.Projected.Sources {
+				if source.Secret != nil {
+					secretSet[source.Secret.Name] = true
+				}
+				if source.ConfigMap != nil {
+					configMapSet[source.ConfigMap.Name] = true
+				}
+			}
+		}
+	}
+	return sortedKeys(secretSet), sortedKeys(configMapSet)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// setReferencesHash annotates the pod with hash of all secrets and config maps it references,
+// therefore any change in these causes the pod to be recreated.
+func setReferencesHash(r *HorreumReconciler, pod *corev1.Pod) error {
+	secrets, configMaps := referencedObjects(&pod.Spec)
+	hash := sha256.New()
+	for _, name := range secrets {
+		secret := &corev1.Secret{}
+		if err := getReferenced(r, types.NamespacedName{Name: name, Namespace: pod.Namespace}, secret); err != nil {
+			if errors.IsNotFound(err) {
+				// The pod won't start anyway; it will be recreated when the secret appears
+				hash.Write([]byte("secret/" + name + "/missing\n"))
+				continue
+			}
+			return err
+		}
+		hash.Write([]byte("secret/" + name + "\n"))
+		for _, key := range sortedDataKeys(secret.Data) {
+			hash.Write([]byte(key + "="))
+			hash.Write(secret.Data[key])
+			hash.Write([]byte("\n"))
+		}
+	}
+	for _, name := range configMaps {
+		configMap := &corev1.ConfigMap{}
+		if err := getReferenced(r, types.NamespacedName{Name: name, Namespace: pod.Namespace}, configMap); err != nil {
+			if errors.IsNotFound(err) {
+				hash.Write([]byte("configmap/" + name + "/missing\n"))
+				continue
+			}
+			return err
+		}
+		hash.Write([]byte("configmap/" + name + "\n"))
+		for _, key := range sortedDataKeys(configMap.BinaryData) {
+			hash.Write([]byte(key + "="))
+			hash.Write(configMap.BinaryData[key])
+			hash.Write([]byte("\n"))
+		}
+		keys := make([]string, 0, len(configMap.Data))
+		for key := range configMap.Data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			hash.Write([]byte(key + "=" + configMap.Data[key] + "\n"))
+		}
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[referencesHashAnnotation] = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
+
+// getReferenced reads the object through the cache; objects just created by this reconciliation
+// may not be cached yet so these are read from the API server.
+func getReferenced(r *HorreumReconciler, name types.NamespacedName, object client.Object) error {
+	err := r.Get(context.TODO(), name, object)
+	if errors.IsNotFound(err) {
+		return r.uncachedReader().Get(context.TODO(), name, object)
+	}
+	return err
+}
+
+func (r *HorreumReconciler) uncachedReader() client.Reader {
+	if r.APIReader != nil {
+		return r.APIReader
+	}
+	return r.Client
+}
+
+// clusterReader reads cluster-scoped objects; when the operator watches only some namespaces these are not cached
+// because the operator is likely installed with namespaced roles and the informers would fail to sync.
+func (r *HorreumReconciler) clusterReader() client.Reader {
+	if len(r.WatchNamespaces) > 0 {
+		return r.uncachedReader()
+	}
+	return r.Client
+}
+
+var reportedForbidden sync.Map
+
+// logClusterReadError logs failure to read cluster-scoped resources; missing permissions are reported only once
+func (r *HorreumReconciler) logClusterReadError(err error, kind string) {
+	if !errors.IsForbidden(err) {
+		r.Log.Error(err, "Cannot read "+kind)
+	} else if _, reported := reportedForbidden.LoadOrStore(kind, true); !reported {
+		r.Log.Info("Operator is not permitted to read " + kind + ", using defaults")
+	}
+}
+
+func sortedDataKeys(data map[string][]byte) []string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Index of Horreum resources by secrets and config maps their pods reference, with values `secret/<name>`
+// and `configmap/<name>`
+const referencesIndex = ".spec.references"
+
+// specReferences lists secrets and config maps derived from the spec, so that these are known even before
+// the pods are created
+func specReferences(cr *hyperfoilv1alpha1.Horreum) []string {
+	secrets := []string{
+		appUserSecret(cr),
+		dbAdminSecret(cr),
+		keycloakAdminSecret(cr),
+		keycloakDbSecret(cr),
+		horreumAdminSecret(cr),
+		cr.Name + "-app-certs",
+		cr.Name + "-keycloak-certs",
+		cr.Spec.Route.TLS,
+		cr.Spec.Keycloak.Route.TLS,
+	}
+	configMaps := []string{
+		"service-ca.crt",
+		cr.Name + "-app-config",
+		cr.Name + "-postgresql-start",
+		cr.Spec.TrustedCABundle,
+	}
+	if cr.Spec.Keycloak.Shared != nil {
+		secrets = append(secrets, keycloakClientSecret(cr))
+	}
+	if shared := cr.Spec.Postgres.Shared; shared != nil && shared.Horreum == "" {
+		secrets = append(secrets, shared.AdminSecret)
+	}
+	if tracing := cr.Spec.Observability.Tracing; tracing != nil {
+		secrets = append(secrets, tracing.HeadersSecret)
+	}
+	for _, customization := range []*hyperfoilv1alpha1.PodCustomizationSpec{
+		&cr.Spec.PodCustomizationSpec, &cr.Spec.Keycloak.PodCustomizationSpec, &cr.Spec.Postgres.PodCustomizationSpec,
+	} {
+		spec := corev1.PodSpec{
+			Containers:     append([]corev1.Container{{Env: customization.ExtraEnv}}, customization.Sidecars...),
+			InitContainers: customization.ExtraInitContainers,
+			Volumes:        customization.ExtraVolumes,
+		}
+		customSecrets, customConfigMaps := referencedObjects(&spec)
+		secrets = append(secrets, customSecrets...)
+		configMaps = append(configMaps, customConfigMaps...)
+	}
+	references := []string{}
+	for _, name := range secrets {
+		if name != "" {
+			references = append(references, "secret/"+name)
+		}
+	}
+	for _, name := range configMaps {
+		if name != "" {
+			references = append(references, "configmap/"+name)
+		}
+	}
+	return references
+}
+
+func indexReferences(obj client.Object) []string {
+	cr, ok := obj.(*hyperfoilv1alpha1.Horreum)
+	if !ok {
+		return nil
+	}
+	return specReferences(cr)
+}
+
+// findReferencingHorreums maps a secret or config map to Horreum resources that reference it.
+// This covers also objects not owned by the Horreum resource (e.g. user-provided TLS secrets).
+func (r *HorreumReconciler) findReferencingHorreums(obj client.Object) []reconcile.Request {
+	reference := "configmap/" + obj.GetName()
+	if _, isSecret := obj.(*corev1.Secret); isSecret {
+		reference = "secret/" + obj.GetName()
+	}
+	list := &hyperfoilv1alpha1.HorreumList{}
+	if err := r.List(context.TODO(), list, client.InNamespace(obj.GetNamespace()),
+		client.MatchingFields{referencesIndex: reference}); err != nil {
+		r.Log.Error(err, "Cannot list Horreum resources in namespace "+obj.GetNamespace())
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, cr := range list.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Name: cr.Name, Namespace: cr.Namespace},
+		})
+	}
+	return requests
+}
@@ -0,0 +1,406 @@
+package horreum
+
+import (
+	"bytes"
+	"context"
+	cryptotls "crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	stdErrors "errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	logr "github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const keycloakClientSecretKey = "clientsecret"
+
+// Realm attribute holding UID of the Horreum resource the realm was created for
+const realmOwnerAttribute = "hyperfoil.io/horreum-uid"
+
+// Realms of Keycloak itself and of the Horreum resource deploying it
+var reservedRealms = []string{"master", "horreum"}
+
+// Realm roles Horreum expects in addition to the team roles created by users
+var horreumRealmRoles = []string{"admin", "manager", "tester", "uploader", "viewer"}
+
+// keycloakDeployed returns true when the operator runs a Keycloak instance for this resource
+func keycloakDeployed(cr *hyperfoilv1alpha1.Horreum) bool {
+	return cr.Spec.Keycloak.External.PublicUri == "" && cr.Spec.Keycloak.Shared == nil
+}
+
+func keycloakRealm(cr *hyperfoilv1alpha1.Horreum) string {
+	if shared := cr.Spec.Keycloak.Shared; shared != nil {
+		return withDefault(shared.Realm, cr.Namespace+"-"+cr.Name)
+	}
+	return "horreum"
+}
+
+func keycloakClientSecret(cr *hyperfoilv1alpha1.Horreum) string {
+	return cr.Name + "-keycloak-client"
+}
+
+func sharedKeycloakProviderName(cr *hyperfoilv1alpha1.Horreum) types.NamespacedName {
+	shared := cr.Spec.Keycloak.Shared
+	return types.NamespacedName{Name: shared.Horreum, Namespace: withDefault(shared.Namespace, cr.Namespace)}
+}
+
+// sharedKeycloakProvider returns the Horreum resource deploying the shared Keycloak, or nil if it does not exist.
+// Fails when the provider does not permit this resource or when the realm is reserved or used by another resource.
+func sharedKeycloakProvider(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum) (*hyperfoilv1alpha1.Horreum, error) {
+	provider := &hyperfoilv1alpha1.Horreum{}
+	if err := r.Get(context.TODO(), sharedKeycloakProviderName(cr), provider); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !keycloakDeployed(provider) {
+		return nil, stdErrors.New("Horreum " + provider.Namespace + "/" + provider.Name + " does not deploy Keycloak")
+	}
+	if !sharingPermitted(cr, provider, provider.Spec.Keycloak.SharedNamespaces) {
+		return nil, stdErrors.New("Horreum " + provider.Namespace + "/" + provider.Name +
+			" does not permit namespace " + cr.Namespace + " in spec.keycloak.sharedNamespaces")
+	}
+	realm := keycloakRealm(cr)
+	for _, reserved := range reservedRealms {
+		if realm == reserved {
+			return nil, stdErrors.New("realm " + realm + " is reserved")
+		}
+	}
+	list := &hyperfoilv1alpha1.HorreumList{}
+	if err := r.List(context.TODO(), list); err != nil {
+		return nil, err
+	}
+	for _, other := range list.Items {
+		if shared := other.Status.SharedKeycloak; other.UID != cr.UID && shared != nil &&
+			shared.Horreum == provider.Namespace+"/"+provider.Name && shared.Realm == realm {
+			return nil, stdErrors.New("realm " + realm + " is used by Horreum " + other.Namespace + "/" + other.Name)
+		}
+	}
+	return provider, nil
+}
+
+// sharingPermitted returns true when the consumer is in the same namespace as the provider or in one of the namespaces
+// the provider shares its component with
+func sharingPermitted(cr *hyperfoilv1alpha1.Horreum, provider *hyperfoilv1alpha1.Horreum, namespaces []string) bool {
+	if cr.Namespace == provider.Namespace {
+		return true
+	}
+	for _, namespace := range namespaces {
+		if namespace == cr.Namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// ownsRealm returns true when the realm representation carries UID of this resource
+func ownsRealm(cr *hyperfoilv1alpha1.Horreum, realm map[string]interface{}) bool {
+	attributes, _ := realm["attributes"].(map[string]interface{})
+	return attributes[realmOwnerAttribute] == string(cr.UID)
+}
+
+func newKeycloakClientSecret(cr *hyperfoilv1alpha1.Horreum) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      keycloakClientSecret(cr),
+			Namespace: cr.Namespace,
+		},
+		Type: corev1.SecretTypeOpaque,
+		StringData: map[string]string{
+			keycloakClientSecretKey: generatePassword(),
+		},
+	}
+}
+
+// provisionSharedRealm creates the realm with roles, clients and the admin user in the shared Keycloak,
+// and updates the clients when the Horreum URL changes
+func provisionSharedRealm(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger, provider *hyperfoilv1alpha1.Horreum, appPublicUrl string) error {
+	realm := keycloakRealm(cr)
+	status := &hyperfoilv1alpha1.SharedKeycloakStatus{
+		Horreum:     provider.Namespace + "/" + provider.Name,
+		Realm:       realm,
+		RedirectUrl: appPublicUrl,
+	}
+	admin, err := newKeycloakAdmin(r, provider)
+	if err != nil {
+		return err
+	}
+	// The realm could be lost, e.g. when Keycloak database was recreated
+	existing := map[string]interface{}{}
+	code, err := admin.do(http.MethodGet, "/admin/realms/"+realm, nil, &existing)
+	if err != nil && code != http.StatusNotFound {
+		return err
+	} else if current := cr.Status.SharedKeycloak; code != http.StatusNotFound && current != nil && *current == *status && ownsRealm(cr, existing) {
+		return nil
+	}
+	clientSecret, err := secretValue(r, cr.Namespace, keycloakClientSecret(cr), keycloakClientSecretKey)
+	if err != nil {
+		return err
+	}
+	clients := []map[string]interface{}{
+		{
+			"clientId":                  "horreum",
+			"enabled":                   true,
+			"publicClient":              false,
+			"secret":                    clientSecret,
+			"standardFlowEnabled":       false,
+			"directAccessGrantsEnabled": false,
+		},
+		{
+			"clientId":                  "horreum-ui",
+			"enabled":                   true,
+			"publicClient":              true,
+			"standardFlowEnabled":       true,
+			"directAccessGrantsEnabled": true,
+			"rootUrl":                   appPublicUrl,
+			"redirectUris":              []string{appPublicUrl + "/*"},
+			"webOrigins":                []string{appPublicUrl},
+		},
+	}
+	if code == http.StatusNotFound {
+		adminUser, err := secretValue(r, cr.Namespace, horreumAdminSecret(cr), corev1.BasicAuthUsernameKey)
+		if err != nil {
+			return err
+		}
+		adminPassword, err := secretValue(r, cr.Namespace, horreumAdminSecret(cr), corev1.BasicAuthPasswordKey)
+		if err != nil {
+			return err
+		}
+		roles := []map[string]interface{}{}
+		for _, role := range horreumRealmRoles {
+			roles = append(roles, map[string]interface{}{"name": role})
+		}
+		representation := map[string]interface{}{
+			"realm":   realm,
+			"enabled": true,
+			"attributes": map[string]string{
+				realmOwnerAttribute: string(cr.UID),
+			},
+			"roles": map[string]interface{}{
+				"realm": roles,
+			},
+			"clients": clients,
+			"users": []map[string]interface{}{
+				{
+					"username": adminUser,
+					"enabled":  true,
+					"credentials": []map[string]interface{}{
+						{"type": "password", "value": adminPassword, "temporary": false},
+					},
+					"realmRoles": []string{"admin"},
+				},
+			},
+		}
+		if _, err := admin.do(http.MethodPost, "/admin/realms", representation, nil); err != nil {
+			return err
+		}
+		logger.Info("Created realm " + realm + " in Keycloak of Horreum " + status.Horreum)
+		recordEvent(r, cr, corev1.EventTypeNormal, "RealmCreated", "Created realm "+realm+" in Keycloak of Horreum "+status.Horreum)
+	} else if !ownsRealm(cr, existing) {
+		return stdErrors.New("realm " + realm + " exists but was not created for this resource")
+	} else {
+		for _, c := range clients {
+			existing := []map[string]interface{}{}
+			path := "/admin/realms/" + realm + "/clients"
+			if _, err := admin.do(http.MethodGet, path+"?clientId="+url.QueryEscape(c["clientId"].(string)), nil, &existing); err != nil {
+				return err
+			}
+			if len(existing) == 0 {
+				if _, err := admin.do(http.MethodPost, path, c, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			for key, value := range c {
+				existing[0][key] = value
+			}
+			if _, err := admin.do(http.MethodPut, path+"/"+fmt.Sprint(existing[0]["id"]), existing[0], nil); err != nil {
+				return err
+			}
+		}
+		logger.Info("Updated clients in realm " + realm + " in Keycloak of Horreum " + status.Horreum)
+	}
+	cr.Status.SharedKeycloak = status
+	return nil
+}
+
+// deleteSharedRealm removes the realm provisioned for this resource; missing Keycloak is ignored
+func deleteSharedRealm(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger) error {
+	if cr.Status.SharedKeycloak == nil {
+		return nil
+	}
+	provider := &hyperfoilv1alpha1.Horreum{}
+	namespace, name, _ := strings.Cut(cr.Status.SharedKeycloak.Horreum, "/")
+	if err := r.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: name}, provider); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	realm := cr.Status.SharedKeycloak.Realm
+	if !provider.DeletionTimestamp.IsZero() || appStopped(provider) {
+		// Keycloak is not running, the deletion would never complete
+		recordEvent(r, cr, corev1.EventTypeWarning, "RealmRetained",
+			"Keycloak of Horreum "+cr.Status.SharedKeycloak.Horreum+" is not running, realm "+realm+" was not deleted")
+		return nil
+	}
+	admin, err := newKeycloakAdmin(r, provider)
+	if err != nil {
+		return err
+	}
+	existing := map[string]interface{}{}
+	if code, err := admin.do(http.MethodGet, "/admin/realms/"+realm, nil, &existing); code == http.StatusNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	} else if !ownsRealm(cr, existing) {
+		recordEvent(r, cr, corev1.EventTypeWarning, "RealmRetained",
+			"Realm "+realm+" in Keycloak of Horreum "+cr.Status.SharedKeycloak.Horreum+" was not created for this resource, not deleting it")
+		return nil
+	}
+	if code, err := admin.do(http.MethodDelete, "/admin/realms/"+realm, nil, nil); err != nil && code != http.StatusNotFound {
+		return err
+	}
+	logger.Info("Deleted realm " + realm + " in Keycloak of Horreum " + cr.Status.SharedKeycloak.Horreum)
+	return nil
+}
+
+func secretValue(r *HorreumReconciler, namespace string, name string, key string) (string, error) {
+	secret := &corev1.Secret{}
+	// The secret could be just created by this reconciliation
+	if err := r.uncachedReader().Get(context.TODO(), types.NamespacedName{Name: name, Namespace: namespace}, secret); err != nil {
+		return "", err
+	}
+	value, ok := secret.Data[key]
+	if !ok {
+		return "", stdErrors.New("secret " + name + " is missing key " + key)
+	}
+	return string(value), nil
+}
+
+type keycloakAdmin struct {
+	client *http.Client
+	url    string
+	token  string
+}
+
+// newKeycloakAdmin logs into master realm of the Keycloak deployed for the provider, using its admin credentials.
+// The Keycloak certificate is verified using the service CA in provider's namespace, if present, and system CAs.
+func newKeycloakAdmin(r *HorreumReconciler, provider *hyperfoilv1alpha1.Horreum) (*keycloakAdmin, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	serviceCa := &corev1.ConfigMap{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "service-ca.crt", Namespace: provider.Namespace}, serviceCa); err != nil {
+		if !errors.IsNotFound(err) {
+			return nil, err
+		}
+	} else if pem, ok := serviceCa.BinaryData["service-ca.crt"]; ok {
+		pool.AppendCertsFromPEM(pem)
+	} else {
+		pool.AppendCertsFromPEM([]byte(serviceCa.Data["service-ca.crt"]))
+	}
+	admin := &keycloakAdmin{
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &cryptotls.Config{RootCAs: pool},
+			},
+		},
+		url: keycloakInternalURL(provider),
+	}
+	username, err := secretValue(r, provider.Namespace, keycloakAdminSecret(provider), corev1.BasicAuthUsernameKey)
+	if err != nil {
+		return nil, err
+	}
+	password, err := secretValue(r, provider.Namespace, keycloakAdminSecret(provider), corev1.BasicAuthPasswordKey)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type": {"password"},
+		"client_id":  {"admin-cli"},
+		"username":   {username},
+		"password":   {password},
+	}
+	response, err := admin.client.PostForm(admin.url+"/realms/master/protocol/openid-connect/token", form)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cannot log into Keycloak %s: %s", admin.url, response.Status)
+	}
+	token := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+	admin.token = token.AccessToken
+	return admin, nil
+}
+
+// do invokes the admin API; returns status code and error for unsuccessful responses
+func (admin *keycloakAdmin) do(method string, path string, body interface{}, out interface{}) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	request, err := http.NewRequest(method, admin.url+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Authorization", "Bearer "+admin.token)
+	request.Header.Set("Content-Type", "application/json")
+	response, err := admin.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		message, _ := io.ReadAll(response.Body)
+		return response.StatusCode, fmt.Errorf("%s %s failed: %s %s", method, path, response.Status, string(message))
+	}
+	if out != nil {
+		return response.StatusCode, json.NewDecoder(response.Body).Decode(out)
+	}
+	return response.StatusCode, nil
+}
+
+// findSharedKeycloakConsumers maps Horreum resource to resources using its Keycloak
+func (r *HorreumReconciler) findSharedKeycloakConsumers(obj client.Object) []reconcile.Request {
+	list := &hyperfoilv1alpha1.HorreumList{}
+	if err := r.List(context.TODO(), list); err != nil {
+		r.Log.Error(err, "Cannot list Horreum resources")
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, cr := range list.Items {
+		if cr.Spec.Keycloak.Shared != nil &&
+			sharedKeycloakProviderName(&cr) == (types.NamespacedName{Name: obj.GetName(), Namespace: obj.GetNamespace()}) {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: cr.Name, Namespace: cr.Namespace},
+			})
+		}
+	}
+	return requests
+}
@@ -0,0 +1,433 @@
+package horreum
+
+import (
+	"context"
+	stdErrors "errors"
+	"time"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	logr "github.com/go-logr/logr"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// Creates roles and databases of this instance; the script is idempotent so that the Job can be re-run
+// whenever the credentials change. Roles and databases are marked with comment $MARKER and the script
+// fails rather than altering objects that were not created for this instance. Values are passed as psql
+// variables, which are quoted using :'name' (literals) and :"name" (identifiers).
+const provisionDatabaseScript = `
+set -e
+role() {
+	psql -v ON_ERROR_STOP=1 -v role="$1" -v password="$2" -v marker="$MARKER" <<'SQL'
+SELECT count(*) > 0 AS exists, coalesce(bool_or(shobj_description(oid, 'pg_authid') IS DISTINCT FROM :'marker'), false) AS foreign
+	FROM pg_roles WHERE rolname = :'role' \gset
+\if :foreign
+\echo Role :role was not created for this resource
+DO $$ BEGIN RAISE EXCEPTION 'role exists and was not created for this resource'; END $$;
+\elif :exists
+ALTER ROLE :"role" WITH NOINHERIT LOGIN PASSWORD :'password';
+\else
+CREATE ROLE :"role" WITH NOINHERIT LOGIN PASSWORD :'password';
+COMMENT ON ROLE :"role" IS :'marker';
+\endif
+SQL
+}
+database() {
+	psql -v ON_ERROR_STOP=1 -v database="$1" -v owner="$2" -v marker="$MARKER" <<'SQL'
+SELECT count(*) > 0 AS exists, coalesce(bool_or(shobj_description(oid, 'pg_database') IS DISTINCT FROM :'marker'), false) AS foreign
+	FROM pg_database WHERE datname = :'database' \gset
+\if :foreign
+\echo Database :database was not created for this resource
+DO $$ BEGIN RAISE EXCEPTION 'database exists and was not created for this resource'; END $$;
+\elif :exists
+\echo Database :database already exists.
+\else
+CREATE DATABASE :"database" WITH OWNER = :"owner";
+COMMENT ON DATABASE :"database" IS :'marker';
+\endif
+-- Other instances on the server must not connect to this database
+REVOKE ALL ON DATABASE :"database" FROM PUBLIC;
+SQL
+}
+role "$OWNER_USER" "$OWNER_PASSWORD"
+role "$APP_USER" "$APP_PASSWORD"
+role "$KEYCLOAK_USER" "$KEYCLOAK_PASSWORD"
+database "$APP_DATABASE" "$OWNER_USER"
+database "$KEYCLOAK_DATABASE" "$KEYCLOAK_USER"
+psql -v ON_ERROR_STOP=1 -v database="$APP_DATABASE" -v user="$APP_USER" <<'SQL'
+GRANT CONNECT ON DATABASE :"database" TO :"user";
+SQL
+# Adding extension pgcrypto requires superuser priviledges; PGDATABASE is not parsed as connection string
+PGDATABASE="$APP_DATABASE" psql -v ON_ERROR_STOP=1 -c "CREATE EXTENSION IF NOT EXISTS pgcrypto;"
+`
+
+// Drops databases and roles marked as created for this instance. DROP DATABASE ... WITH (FORCE) requires
+// PostgreSQL 13, so new connections are refused and existing ones terminated first; these steps may not be
+// permitted to a non-superuser on an external server, in which case DROP DATABASE fails while anyone is connected.
+const dropDatabaseScript = `
+set -e
+database() {
+	psql -v ON_ERROR_STOP=1 -v database="$1" -v marker="$MARKER" <<'SQL'
+SELECT count(*) > 0 AS owned FROM pg_database
+	WHERE datname = :'database' AND shobj_description(oid, 'pg_database') = :'marker' \gset
+\if :owned
+\set ON_ERROR_STOP 0
+ALTER DATABASE :"database" ALLOW_CONNECTIONS false;
+SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = :'database' AND pid <> pg_backend_pid();
+\set ON_ERROR_STOP 1
+DROP DATABASE :"database";
+\endif
+SQL
+}
+role() {
+	psql -v ON_ERROR_STOP=1 -v role="$1" -v marker="$MARKER" <<'SQL'
+SELECT count(*) > 0 AS owned FROM pg_roles
+	WHERE rolname = :'role' AND shobj_description(oid, 'pg_authid') = :'marker' \gset
+\if :owned
+DROP ROLE :"role";
+\endif
+SQL
+}
+database "$APP_DATABASE"
+database "$KEYCLOAK_DATABASE"
+for user in "$OWNER_USER" "$APP_USER" "$KEYCLOAK_USER"; do
+	role "$user"
+done
+`
+
+// postgresDeployed returns true when the operator runs PostgreSQL server for this resource
+func postgresDeployed(cr *hyperfoilv1alpha1.Horreum) bool {
+	return (cr.Spec.Postgres.Enabled == nil || *cr.Spec.Postgres.Enabled) && cr.Spec.Postgres.Shared == nil
+}
+
+func sharedPostgresProviderName(cr *hyperfoilv1alpha1.Horreum) types.NamespacedName {
+	shared := cr.Spec.Postgres.Shared
+	return types.NamespacedName{Name: shared.Horreum, Namespace: withDefault(shared.Namespace, cr.Namespace)}
+}
+
+// sharedDatabaseObjectName names Jobs and secrets operating on the shared server. With PostgreSQL deployed
+// by another Horreum resource these are created in its namespace, so that its admin credentials do not
+// leave the namespace, and the name includes namespace of this resource.
+func sharedDatabaseObjectName(cr *hyperfoilv1alpha1.Horreum, suffix string) string {
+	if cr.Spec.Postgres.Shared.Horreum == "" {
+		return cr.Name + suffix
+	}
+	return cr.Namespace + "-" + cr.Name + suffix
+}
+
+// dbRoleName prefixes names of database users with the namespace, as roles are shared by all databases on the server
+func dbRoleName(cr *hyperfoilv1alpha1.Horreum, secret string) string {
+	if cr.Spec.Postgres.Shared == nil {
+		return secret
+	}
+	return cr.Namespace + "-" + secret
+}
+
+// dbUserEnv sets the database user from the secret. On shared PostgreSQL the user is always derived
+// from the namespace and secret name, so a secret naming a role of another tenant is not used.
+func dbUserEnv(cr *hyperfoilv1alpha1.Horreum, name string, secret string) corev1.EnvVar {
+	if cr.Spec.Postgres.Shared != nil {
+		return corev1.EnvVar{Name: name, Value: dbRoleName(cr, secret)}
+	}
+	return secretEnv(name, secret, corev1.BasicAuthUsernameKey)
+}
+
+// newDatabaseSecret creates secret with credentials of a database user
+func newDatabaseSecret(cr *hyperfoilv1alpha1.Horreum, name string) *corev1.Secret {
+	secret := newSecret(cr, name)
+	secret.StringData[corev1.BasicAuthUsernameKey] = dbRoleName(cr, name)
+	return secret
+}
+
+// sharedPostgresProvider returns the Horreum resource deploying the shared PostgreSQL, or nil if it does not exist
+func sharedPostgresProvider(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum) (*hyperfoilv1alpha1.Horreum, error) {
+	provider := &hyperfoilv1alpha1.Horreum{}
+	if err := r.Get(context.TODO(), sharedPostgresProviderName(cr), provider); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !postgresDeployed(provider) {
+		return nil, stdErrors.New("Horreum " + provider.Namespace + "/" + provider.Name + " does not deploy PostgreSQL")
+	}
+	if !sharingPermitted(cr, provider, provider.Spec.Postgres.SharedNamespaces) {
+		return nil, stdErrors.New("Horreum " + provider.Namespace + "/" + provider.Name +
+			" does not permit namespace " + cr.Namespace + " in spec.postgres.sharedNamespaces")
+	}
+	return provider, nil
+}
+
+// provisionSharedDatabase runs a Job creating databases and roles of this instance on the shared server;
+// returns true when the Job has completed.
+func provisionSharedDatabase(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger) (bool, error) {
+	shared := cr.Spec.Postgres.Shared
+	var provider *hyperfoilv1alpha1.Horreum
+	if shared.Horreum == "" {
+		if shared.Host == "" || shared.AdminSecret == "" {
+			err := stdErrors.New("postgres.shared must set either horreum, or both host and adminSecret")
+			updateStatus(r, cr, "Error", err.Error())
+			return false, err
+		}
+	} else {
+		var err error
+		provider, err = sharedPostgresProvider(r, cr)
+		if err != nil {
+			updateStatus(r, cr, "Error", "Cannot use shared PostgreSQL: "+err.Error())
+			return false, err
+		} else if provider == nil {
+			// Changes in the provider trigger reconciliation
+			updateStatus(r, cr, "Pending", "Waiting for shared PostgreSQL in Horreum "+sharedPostgresProviderName(cr).String())
+			return false, nil
+		}
+		admin := &corev1.Secret{}
+		if err := r.Get(context.TODO(), types.NamespacedName{Name: dbAdminSecret(provider), Namespace: provider.Namespace}, admin); err != nil {
+			if errors.IsNotFound(err) {
+				updateStatus(r, cr, "Pending", "Waiting for admin credentials of shared PostgreSQL in Horreum "+sharedPostgresProviderName(cr).String())
+				return false, nil
+			}
+			return false, err
+		}
+	}
+	credentials, err := databaseCredentials(r, cr, provider)
+	if err != nil {
+		return false, err
+	}
+	if err := ensureSame(r, cr, logger, credentials, &corev1.Secret{}, compareSecretData, nocheck); err != nil {
+		return false, err
+	}
+	job, err := databaseJob(r, cr, provider, "-db-provision", provisionDatabaseScript)
+	if err != nil {
+		return false, err
+	}
+	if err := ensureSame(r, cr, logger, job, &batchv1.Job{}, compareJobs, checkJob); err != nil {
+		return false, err
+	}
+	found := &batchv1.Job{}
+	if err := r.uncachedReader().Get(context.TODO(), types.NamespacedName{Name: job.Name, Namespace: job.Namespace}, found); err != nil {
+		return false, err
+	}
+	ok, _, _ := checkJob(found)
+	if ok {
+		cr.Status.SharedDatabaseProvisioned = true
+	}
+	return ok, nil
+}
+
+// dropSharedDatabase runs a Job removing databases and roles of this instance from the shared server;
+// returns true when the Job has completed or the server is not available anymore.
+func dropSharedDatabase(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger) (bool, error) {
+	if cr.Spec.Postgres.Shared == nil || !cr.Status.SharedDatabaseProvisioned {
+		return true, nil
+	}
+	var provider *hyperfoilv1alpha1.Horreum
+	if cr.Spec.Postgres.Shared.Horreum != "" {
+		provider = &hyperfoilv1alpha1.Horreum{}
+		err := r.Get(context.TODO(), sharedPostgresProviderName(cr), provider)
+		if err != nil && !errors.IsNotFound(err) {
+			return false, err
+		} else if errors.IsNotFound(err) || !provider.DeletionTimestamp.IsZero() || !postgresDeployed(provider) ||
+			provider.Spec.Mode == modeStopped {
+			// PostgreSQL is not running, the Job would never complete
+			recordEvent(r, cr, corev1.EventTypeWarning, "DatabaseRetained",
+				"PostgreSQL of Horreum "+sharedPostgresProviderName(cr).String()+" is not running, database "+
+					databaseName(cr)+" was not deleted")
+			return true, nil
+		}
+	}
+	job, err := databaseJob(r, cr, provider, "-db-cleanup", dropDatabaseScript)
+	if err != nil {
+		return false, err
+	}
+	if err := ensureSame(r, cr, logger, job, &batchv1.Job{}, compareJobs, nocheck); err != nil {
+		return false, err
+	}
+	found := &batchv1.Job{}
+	if err := r.uncachedReader().Get(context.TODO(), types.NamespacedName{Name: job.Name, Namespace: job.Namespace}, found); err != nil {
+		return false, err
+	}
+	ok, status, reason := checkJob(found)
+	if status == "Error" {
+		recordEvent(r, cr, corev1.EventTypeWarning, "DatabaseRetained", "Job "+job.Name+reason+", database "+
+			databaseName(cr)+" was not deleted")
+		return true, nil
+	} else if ok {
+		logger.Info("Deleted database " + databaseName(cr) + " from shared PostgreSQL")
+	}
+	return ok, nil
+}
+
+// databaseCredentials copies credentials of the database users of this resource into the namespace where the Job runs
+func databaseCredentials(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, provider *hyperfoilv1alpha1.Horreum) (*corev1.Secret, error) {
+	data := map[string][]byte{}
+	users := map[string]string{"OWNER": dbAdminSecret(cr), "APP": appUserSecret(cr), "KEYCLOAK": keycloakDbSecret(cr)}
+	for prefix, secret := range users {
+		password, err := secretValue(r, cr.Namespace, secret, corev1.BasicAuthPasswordKey)
+		if err != nil {
+			return nil, err
+		}
+		data[prefix+"_USER"] = []byte(dbRoleName(cr, secret))
+		data[prefix+"_PASSWORD"] = []byte(password)
+	}
+	namespace, instance := cr.Namespace, cr.Name
+	if provider != nil {
+		namespace, instance = provider.Namespace, provider.Name
+	}
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      sharedDatabaseObjectName(cr, "-db-credentials"),
+			Namespace: namespace,
+			Labels: map[string]string{
+				"app": instance,
+			},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: data,
+	}, nil
+}
+
+// databaseJob runs the script with admin credentials of the shared server. Without provider (external server)
+// the Job runs in namespace of this resource.
+func databaseJob(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, provider *hyperfoilv1alpha1.Horreum, suffix string, script string) (*batchv1.Job, error) {
+	shared := cr.Spec.Postgres.Shared
+	host, port := shared.Host, shared.Port
+	namespace, instance, adminSecret := cr.Namespace, cr.Name, shared.AdminSecret
+	if provider != nil {
+		host, port = provider.Name+"-db", 5432
+		namespace, instance, adminSecret = provider.Namespace, provider.Name, dbAdminSecret(provider)
+	}
+	credentials := sharedDatabaseObjectName(cr, "-db-credentials")
+	// Any PostgreSQL image provides psql
+	image := dbImage(cr, r, dbImageProfile(cr, r))
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      sharedDatabaseObjectName(cr, suffix),
+			Namespace: namespace,
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy: corev1.RestartPolicyNever,
+			Containers: []corev1.Container{
+				{
+					Name:    "psql",
+					Image:   r.mirrorImage(image),
+					Command: []string{"/bin/sh", "-c", script},
+					Env: []corev1.EnvVar{
+						{
+							Name:  "PGHOST",
+							Value: host,
+						},
+						{
+							Name:  "PGPORT",
+							Value: withDefaultInt(port, 5432),
+						},
+						{
+							Name:  "PGDATABASE",
+							Value: "postgres",
+						},
+						secretEnv("PGUSER", adminSecret, corev1.BasicAuthUsernameKey),
+						secretEnv("PGPASSWORD", adminSecret, corev1.BasicAuthPasswordKey),
+						{
+							Name:  "APP_DATABASE",
+							Value: databaseName(cr),
+						},
+						{
+							Name:  "KEYCLOAK_DATABASE",
+							Value: keycloakDatabaseName(cr),
+						},
+						{
+							Name:  "MARKER",
+							Value: "Horreum " + string(cr.UID),
+						},
+						secretEnv("OWNER_USER", credentials, "OWNER_USER"),
+						secretEnv("OWNER_PASSWORD", credentials, "OWNER_PASSWORD"),
+						secretEnv("APP_USER", credentials, "APP_USER"),
+						secretEnv("APP_PASSWORD", credentials, "APP_PASSWORD"),
+						secretEnv("KEYCLOAK_USER", credentials, "KEYCLOAK_USER"),
+						secretEnv("KEYCLOAK_PASSWORD", credentials, "KEYCLOAK_PASSWORD"),
+					},
+					Resources: withDefaultResources(cr.Spec.Postgres.Resources, r.operatorConfig().Resources.Postgres),
+				},
+			},
+		},
+	}
+	// The Job is recreated when credentials change
+	if err := setReferencesHash(r, pod); err != nil {
+		return nil, err
+	}
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pod.Name,
+			Namespace:   namespace,
+			Annotations: pod.Annotations,
+			Labels: map[string]string{
+				"app": instance,
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &[]int32{3}[0],
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{
+						"app":     instance,
+						"service": "db-job",
+					},
+				},
+				Spec: pod.Spec,
+			},
+		},
+	}, nil
+}
+
+// sharedDatabaseRequeue polls for completion of the Job when it runs in another namespace;
+// otherwise the Job is owned by the resource and its completion triggers reconciliation
+func sharedDatabaseRequeue(cr *hyperfoilv1alpha1.Horreum) reconcile.Result {
+	if cr.Spec.Postgres.Shared.Horreum == "" {
+		return reconcile.Result{}
+	}
+	return reconcile.Result{RequeueAfter: 10 * time.Second}
+}
+
+// deleteSharedDatabaseObjects removes Jobs and credentials created in namespace of the Horreum resource
+// deploying the shared PostgreSQL; owner references cannot be used across namespaces.
+func deleteSharedDatabaseObjects(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum) error {
+	if cr.Spec.Postgres.Shared == nil || cr.Spec.Postgres.Shared.Horreum == "" {
+		return nil
+	}
+	namespace := sharedPostgresProviderName(cr).Namespace
+	for _, suffix := range []string{"-db-provision", "-db-cleanup"} {
+		job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: sharedDatabaseObjectName(cr, suffix), Namespace: namespace}}
+		// Jobs would orphan their pods by default
+		if err := r.Delete(context.TODO(), job, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: sharedDatabaseObjectName(cr, "-db-credentials"), Namespace: namespace}}
+	if err := r.Delete(context.TODO(), secret); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// findSharedPostgresConsumers maps Horreum resource to resources using its PostgreSQL
+func (r *HorreumReconciler) findSharedPostgresConsumers(obj client.Object) []reconcile.Request {
+	list := &hyperfoilv1alpha1.HorreumList{}
+	if err := r.List(context.TODO(), list); err != nil {
+		r.Log.Error(err, "Cannot list Horreum resources")
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, cr := range list.Items {
+		if cr.Spec.Postgres.Shared != nil && cr.Spec.Postgres.Shared.Horreum != "" &&
+			sharedPostgresProviderName(&cr) == (types.NamespacedName{Name: obj.GetName(), Namespace: obj.GetNamespace()}) {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: cr.Name, Namespace: cr.Namespace},
+			})
+		}
+	}
+	return requests
+}
@@ -0,0 +1,218 @@
+package horreum
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const tracingHeadersKey = "headers"
+const tracerName = "github.com/Hyperfoil/horreum-operator"
+
+func tracingProtocol(tracing *hyperfoilv1alpha1.TracingSpec) string {
+	return withDefault(tracing.Protocol, "grpc")
+}
+
+func tracingSamplerRatio(tracing *hyperfoilv1alpha1.TracingSpec) string {
+	return withDefault(tracing.SamplerRatio, "1.0")
+}
+
+func appTracingEnv(cr *hyperfoilv1alpha1.Horreum) []corev1.EnvVar {
+	tracing := cr.Spec.Observability.Tracing
+	if tracing == nil {
+		return nil
+	}
+	env := []corev1.EnvVar{
+		{
+			Name:  "QUARKUS_OTEL_EXPORTER_OTLP_TRACES_ENDPOINT",
+			Value: tracing.Endpoint,
+		},
+		{
+			Name:  "QUARKUS_OTEL_EXPORTER_OTLP_TRACES_PROTOCOL",
+			Value: tracingProtocol(tracing),
+		},
+		{
+			Name:  "QUARKUS_OTEL_TRACES_SAMPLER",
+			Value: "parentbased_traceidratio",
+		},
+		{
+			Name:  "QUARKUS_OTEL_TRACES_SAMPLER_ARG",
+			Value: tracingSamplerRatio(tracing),
+		},
+	}
+	if tracing.HeadersSecret != "" {
+		env = append(env, secretEnv("QUARKUS_OTEL_EXPORTER_OTLP_TRACES_HEADERS", tracing.HeadersSecret, tracingHeadersKey))
+	}
+	return env
+}
+
+func keycloakTracingEnv(cr *hyperfoilv1alpha1.Horreum) []corev1.EnvVar {
+	tracing := cr.Spec.Observability.Tracing
+	if tracing == nil {
+		return nil
+	}
+	return []corev1.EnvVar{
+		{
+			Name:  "KC_TRACING_ENABLED",
+			Value: "true",
+		},
+		{
+			Name:  "KC_TRACING_ENDPOINT",
+			Value: tracing.Endpoint,
+		},
+		{
+			Name:  "KC_TRACING_PROTOCOL",
+			Value: tracingProtocol(tracing),
+		},
+		{
+			Name:  "KC_TRACING_SAMPLER_RATIO",
+			Value: tracingSamplerRatio(tracing),
+		},
+	}
+}
+
+type tracerProvider struct {
+	config   string
+	provider *sdktrace.TracerProvider
+}
+
+// Each Horreum resource may export the traces to a different collector
+var tracerProviders = struct {
+	sync.Mutex
+	byInstance map[types.NamespacedName]tracerProvider
+}{byInstance: map[types.NamespacedName]tracerProvider{}}
+
+// startReconcileSpan starts the root span for reconciliation; phases are recorded as its children
+func startReconcileSpan(ctx context.Context, r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum) (context.Context, trace.Span) {
+	var tracer trace.Tracer
+	provider, err := instanceTracerProvider(ctx, r, cr)
+	if err != nil {
+		r.Log.Error(err, "Cannot set up tracing", "Request.Namespace", cr.Namespace, "Request.Name", cr.Name)
+	}
+	if provider == nil {
+		tracer = trace.NewNoopTracerProvider().Tracer(tracerName)
+	} else {
+		tracer = provider.Tracer(tracerName)
+	}
+	return tracer.Start(ctx, "Reconcile", trace.WithAttributes(
+		attribute.String("horreum.namespace", cr.Namespace),
+		attribute.String("horreum.name", cr.Name),
+	))
+}
+
+// endSpan records status of the resource, so that spans of reconciliations that ended early can be told apart
+func endSpan(span trace.Span, cr *hyperfoilv1alpha1.Horreum) {
+	span.SetAttributes(attribute.String("horreum.status", cr.Status.Status))
+	if cr.Status.Status == "Error" {
+		span.SetStatus(codes.Error, cr.Status.Reason)
+	}
+	span.End()
+}
+
+func instanceTracerProvider(ctx context.Context, r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum) (*sdktrace.TracerProvider, error) {
+	key := types.NamespacedName{Namespace: cr.Namespace, Name: cr.Name}
+	tracing := cr.Spec.Observability.Tracing
+	if tracing == nil {
+		shutdownTracerProvider(key)
+		return nil, nil
+	}
+	headers := map[string]string{}
+	if tracing.HeadersSecret != "" {
+		secret := &corev1.Secret{}
+		if err := r.Get(ctx, types.NamespacedName{Name: tracing.HeadersSecret, Namespace: cr.Namespace}, secret); err != nil {
+			return nil, err
+		}
+		for _, pair := range strings.Split(string(secret.Data[tracingHeadersKey]), ",") {
+			if name, value, ok := strings.Cut(pair, "="); ok {
+				headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+			}
+		}
+	}
+	config := tracing.Endpoint + "|" + tracingProtocol(tracing) + "|" + tracingSamplerRatio(tracing) + "|" + tracing.HeadersSecret + "|"
+	for _, name := range sortedKeys(setOf(headers)) {
+		config += name + "=" + headers[name] + ","
+	}
+
+	tracerProviders.Lock()
+	defer tracerProviders.Unlock()
+	if existing, ok := tracerProviders.byInstance[key]; ok {
+		if existing.config == config {
+			return existing.provider, nil
+		}
+		go existing.provider.Shutdown(context.Background())
+		delete(tracerProviders.byInstance, key)
+	}
+	exporter, err := newTraceExporter(ctx, tracing, headers)
+	if err != nil {
+		return nil, err
+	}
+	ratio, err := strconv.ParseFloat(tracingSamplerRatio(tracing), 64)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(sdkresource.NewSchemaless(semconv.ServiceNameKey.String("horreum-operator"))),
+	)
+	tracerProviders.byInstance[key] = tracerProvider{config: config, provider: provider}
+	return provider, nil
+}
+
+func newTraceExporter(ctx context.Context, tracing *hyperfoilv1alpha1.TracingSpec, headers map[string]string) (*otlptrace.Exporter, error) {
+	endpoint, err := url.Parse(tracing.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if tracingProtocol(tracing) == "http/protobuf" {
+		options := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(endpoint.Host),
+			otlptracehttp.WithURLPath(strings.TrimSuffix(endpoint.Path, "/") + "/v1/traces"),
+			otlptracehttp.WithHeaders(headers),
+		}
+		if endpoint.Scheme == "http" {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, options...)
+	}
+	options := []otlptracegrpc.Option{
+		otlptracegrpc.WithEndpoint(endpoint.Host),
+		otlptracegrpc.WithHeaders(headers),
+	}
+	if endpoint.Scheme == "http" {
+		options = append(options, otlptracegrpc.WithInsecure())
+	}
+	return otlptracegrpc.New(ctx, options...)
+}
+
+func shutdownTracerProvider(key types.NamespacedName) {
+	tracerProviders.Lock()
+	defer tracerProviders.Unlock()
+	if existing, ok := tracerProviders.byInstance[key]; ok {
+		go existing.provider.Shutdown(context.Background())
+		delete(tracerProviders.byInstance, key)
+	}
+}
+
+func setOf(m map[string]string) map[string]bool {
+	set := map[string]bool{}
+	for key := range m {
+		set[key] = true
+	}
+	return set
+}
@@ -77,8 +77,137 @@ func secretEnv(name string, secret string, key string) corev1.EnvVar {
 	}
 }
 
+const trustedCABundleKey = "ca-bundle.crt"
+
+func trustedCAVolume(cr *hyperfoilv1alpha1.Horreum) corev1.Volume {
+	return corev1.Volume{
+		Name: "trusted-ca",
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: cr.Spec.TrustedCABundle,
+				},
+				Items: []corev1.KeyToPath{
+					{
+						Key:  trustedCABundleKey,
+						Path: trustedCABundleKey,
+					},
+				},
+			},
+		},
+	}
+}
+
+func trustedCAMount(dir string) corev1.VolumeMount {
+	return corev1.VolumeMount{
+		Name:      "trusted-ca",
+		MountPath: dir,
+		ReadOnly:  true,
+	}
+}
+
+func applyScheduling(spec *corev1.PodSpec, scheduling *hyperfoilv1alpha1.SchedulingSpec) {
+	spec.NodeSelector = scheduling.NodeSelector
+	spec.Tolerations = scheduling.Tolerations
+	spec.Affinity = scheduling.Affinity
+	spec.TopologySpreadConstraints = scheduling.TopologySpreadConstraints
+	spec.PriorityClassName = scheduling.PriorityClassName
+}
+
+// applyCustomization merges user additions into the pod; the first container is considered the main one
+func applyCustomization(pod *corev1.Pod, customization *hyperfoilv1alpha1.PodCustomizationSpec) {
+	main := &pod.Spec.Containers[0]
+	for _, env := range customization.ExtraEnv {
+		if !hasEnv(main.Env, env.Name) {
+			main.Env = append(main.Env, env)
+		}
+	}
+	main.VolumeMounts = append(main.VolumeMounts, customization.ExtraVolumeMounts...)
+	pod.Spec.Volumes = append(pod.Spec.Volumes, customization.ExtraVolumes...)
+	pod.Spec.Containers = append(pod.Spec.Containers, customization.Sidecars...)
+	pod.Spec.InitContainers = append(pod.Spec.InitContainers, customization.ExtraInitContainers...)
+	pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, customization.ImagePullSecrets...)
+	if len(customization.PodLabels) > 0 && pod.Labels == nil {
+		pod.Labels = map[string]string{}
+	}
+	for key, value := range customization.PodLabels {
+		if _, ok := pod.Labels[key]; !ok {
+			pod.Labels[key] = value
+		}
+	}
+	if len(customization.PodAnnotations) > 0 && pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	for key, value := range customization.PodAnnotations {
+		pod.Annotations[key] = value
+	}
+}
+
+func hasEnv(env []corev1.EnvVar, name string) bool {
+	for _, e := range env {
+		if e.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func httpProbe(path string, port int32, scheme corev1.URIScheme, periodSeconds int32, failureThreshold int32) *corev1.Probe {
+	return &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path:   path,
+				Port:   intstr.FromInt(int(port)),
+				Scheme: scheme,
+			},
+		},
+		PeriodSeconds:    periodSeconds,
+		FailureThreshold: failureThreshold,
+	}
+}
+
+func execProbe(command []string, periodSeconds int32, failureThreshold int32) *corev1.Probe {
+	return &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{
+			Exec: &corev1.ExecAction{
+				Command: command,
+			},
+		},
+		PeriodSeconds:    periodSeconds,
+		FailureThreshold: failureThreshold,
+	}
+}
+
+func withDefaultResources(custom corev1.ResourceRequirements, def corev1.ResourceRequirements) corev1.ResourceRequirements {
+	if custom.Limits == nil && custom.Requests == nil {
+		return def
+	}
+	return custom
+}
+
+// withDefaultProbe fills in all fields the API server defaults; otherwise the pod would never match the desired state
+func withDefaultProbe(custom *corev1.Probe, def *corev1.Probe) *corev1.Probe {
+	probe := def
+	if custom != nil {
+		probe = custom.DeepCopy()
+	}
+	if probe.TimeoutSeconds == 0 {
+		probe.TimeoutSeconds = 1
+	}
+	if probe.PeriodSeconds == 0 {
+		probe.PeriodSeconds = 10
+	}
+	if probe.SuccessThreshold == 0 {
+		probe.SuccessThreshold = 1
+	}
+	if probe.FailureThreshold == 0 {
+		probe.FailureThreshold = 3
+	}
+	return probe
+}
+
 func tls(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, route hyperfoilv1alpha1.RouteSpec) (*routev1.TLSConfig, error) {
-	switch cr.Spec.Route.Type {
+	switch route.Type {
 	case "http":
 		return nil, nil
 	// passthrough route must not set certs
@@ -89,8 +218,8 @@ func tls(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, route hyperfoilv1a
 		}, nil
 	}
 	tlsSecret := corev1.Secret{}
-	if cr.Spec.Route.TLS != "" {
-		if error := r.Get(context.TODO(), types.NamespacedName{Name: cr.Spec.Route.TLS, Namespace: cr.Namespace}, &tlsSecret); error != nil {
+	if route.TLS != "" {
+		if error := r.Get(context.TODO(), types.NamespacedName{Name: route.TLS, Namespace: cr.Namespace}, &tlsSecret); error != nil {
 			updateStatus(r, cr, "Error", "Cannot find secret "+route.TLS)
 			return nil, error
 		}
@@ -100,14 +229,14 @@ func tls(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, route hyperfoilv1a
 		cacert = string(bytes)
 	}
 	var termination routev1.TLSTerminationType
-	switch cr.Spec.Route.Type {
+	switch route.Type {
 	case "edge":
 		termination = routev1.TLSTerminationEdge
 	case "reencrypt", "":
 		termination = routev1.TLSTerminationReencrypt
 	default:
-		log.Println("Invalid route type: " + cr.Spec.Route.Type)
-		return nil, errors.New("Invalid route type: " + cr.Spec.Route.Type)
+		log.Println("Invalid route type: " + route.Type)
+		return nil, errors.New("Invalid route type: " + route.Type)
 	}
 	return &routev1.TLSConfig{
 		Termination:                   termination,
@@ -119,7 +248,7 @@ func tls(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, route hyperfoilv1a
 }
 
 func route(route hyperfoilv1alpha1.RouteSpec, suffix string, cr *hyperfoilv1alpha1.Horreum, r *HorreumReconciler) (*routev1.Route, error) {
-	if !r.RoutesAvailable {
+	if !r.useRoutes() {
 		return nil, nil
 	}
 	subdomain := ""
@@ -142,21 +271,25 @@ func route(route hyperfoilv1alpha1.RouteSpec, suffix string, cr *hyperfoilv1alph
 				Kind: "Service",
 				Name: cr.Name + suffix,
 			},
+			Port: &routev1.RoutePort{
+				TargetPort: intstr.FromString(servicePortName(route)),
+			},
 			TLS: tls,
 		},
 	}, nil
 }
 
 func innerProtocol(route hyperfoilv1alpha1.RouteSpec) string {
-	if route.Type == "http" || route.Type == "edge" {
-		return "http://"
-	} else {
-		return "https://"
-	}
+	return servicePortName(route) + "://"
+}
+
+// servicePortName returns name of the service port the route targets
+func servicePortName(route hyperfoilv1alpha1.RouteSpec) string {
+	return ifThenElse(route.Type == "http" || route.Type == "edge", "http", "https")
 }
 
 func servicePort(route hyperfoilv1alpha1.RouteSpec, httpPort int32, httpsPort int32) corev1.ServicePort {
-	if route.Type == "http" || route.Type == "edge" {
+	if servicePortName(route) == "http" {
 		return corev1.ServicePort{
 			Name: "http",
 			Port: int32(80),
@@ -178,7 +311,7 @@ func servicePort(route hyperfoilv1alpha1.RouteSpec, httpPort int32, httpsPort in
 func serviceType(svcType corev1.ServiceType, r *HorreumReconciler) corev1.ServiceType {
 	if svcType != "" {
 		return svcType
-	} else if r.RoutesAvailable {
+	} else if r.useRoutes() {
 		return corev1.ServiceTypeClusterIP
 	} else {
 		return corev1.ServiceTypeNodePort
@@ -0,0 +1,301 @@
+package horreum
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+	logr "github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Upgrade phases, in order
+const (
+	upgradePhaseBackup     = "Backup"
+	upgradePhaseMigration  = "Migration"
+	upgradePhaseKeycloak   = "Keycloak"
+	upgradePhaseApp        = "App"
+	upgradePhaseRolledBack = "RolledBack"
+)
+
+var upgradePhases = []string{upgradePhaseBackup, upgradePhaseMigration, upgradePhaseKeycloak, upgradePhaseApp}
+
+const defaultUpgradeTimeout = 15 * time.Minute
+const upgradePollInterval = 10 * time.Second
+
+func upgradePhaseIndex(phase string) int {
+	for i, p := range upgradePhases {
+		if p == phase {
+			return i
+		}
+	}
+	return -1
+}
+
+// versionedImage selects image for the component: during upgrade the component keeps running
+// the current image until the upgrade reaches it and then runs the target version pinned by digest
+// as soon as it is known; otherwise digest of the running version is preferred over the tag.
+func versionedImage(cr *hyperfoilv1alpha1.Horreum, repository string, current string, phase string) string {
+	upgrade := cr.Status.Upgrade
+	if upgrade != nil && upgrade.TargetVersion == cr.Spec.Version {
+		if !componentUpgraded(upgrade, phase) {
+			if current != "" {
+				return current
+			}
+		} else if pinned := ifThenElse(phase == upgradePhaseApp, upgrade.AppImage, upgrade.KeycloakImage); pinned != "" {
+			return pinned
+		}
+	}
+	if cr.Spec.Version == "" {
+		return repository + ":latest"
+	}
+	if cr.Status.Current.Version == cr.Spec.Version && current != "" {
+		return current
+	}
+	return repository + ":" + cr.Spec.Version
+}
+
+// componentUpgraded returns true when the component identified by its phase should run the target version.
+// The application switches to the target version in the migration phase, once the previous version is stopped.
+func componentUpgraded(upgrade *hyperfoilv1alpha1.UpgradeStatus, phase string) bool {
+	if phase == upgradePhaseApp && upgrade.Phase == upgradePhaseMigration {
+		return upgrade.Stopped
+	}
+	return upgradePhaseIndex(upgrade.Phase) >= upgradePhaseIndex(ifThenElse(phase == upgradePhaseApp, upgradePhaseMigration, phase))
+}
+
+// appScaledDown returns true when the application deployment should have no replicas
+func appScaledDown(cr *hyperfoilv1alpha1.Horreum) bool {
+	return appStopped(cr) || cr.Status.Upgrade != nil && cr.Status.Upgrade.Phase == upgradePhaseMigration && !cr.Status.Upgrade.Stopped
+}
+
+// appMigrating returns true when a single replica of the new version should migrate the database
+func appMigrating(cr *hyperfoilv1alpha1.Horreum) bool {
+	return cr.Status.Upgrade != nil && cr.Status.Upgrade.Phase == upgradePhaseMigration && cr.Status.Upgrade.Stopped
+}
+
+func setUpgradePhase(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, phase string) {
+	cr.Status.Upgrade.Phase = phase
+	cr.Status.Upgrade.PhaseStarted = metav1.Now()
+	recordEvent(r, cr, corev1.EventTypeNormal, "Upgrading", "Upgrade to "+cr.Status.Upgrade.TargetVersion+": "+phase)
+}
+
+// reconcileUpgrade advances the upgrade state machine based on observed state of the components.
+// Returns non-zero duration when the reconciliation should be repeated to poll for progress.
+func reconcileUpgrade(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger) (time.Duration, error) {
+	if cr.Status.Upgrade != nil && cr.Status.Upgrade.TargetVersion != cr.Spec.Version {
+		// Version changed during the upgrade or after rollback; continue from the running version
+		logger.Info("Abandoning upgrade to " + cr.Status.Upgrade.TargetVersion)
+		cr.Status.Upgrade = nil
+	}
+	if cr.Status.Upgrade == nil {
+		// Nothing has been running yet (or current version was not recorded) so there's nothing to upgrade
+		if cr.Spec.Version == cr.Status.Current.Version || cr.Status.Current.AppImage == "" || appStopped(cr) {
+			return 0, nil
+		}
+		logger.Info("Upgrading from " + withDefault(cr.Status.Current.Version, "latest") + " to " + cr.Spec.Version)
+		cr.Status.Upgrade = &hyperfoilv1alpha1.UpgradeStatus{TargetVersion: cr.Spec.Version}
+		setUpgradePhase(r, cr, upgradePhaseBackup)
+	}
+	upgrade := cr.Status.Upgrade
+	switch upgrade.Phase {
+	case upgradePhaseBackup:
+		done, err := backupBeforeUpgrade(r, cr, upgrade)
+		if err != nil {
+			return 0, err
+		} else if !done {
+			setStatus(r, cr, "Pending", "Upgrading to "+upgrade.TargetVersion+": waiting for database backup "+upgrade.Backup)
+			return upgradePollInterval, nil
+		}
+		setUpgradePhase(r, cr, upgradePhaseMigration)
+	case upgradePhaseMigration:
+		if !upgrade.Stopped {
+			// Old application must not run while the new version migrates the database
+			deployment := &appsv1.Deployment{}
+			if err := r.Get(context.TODO(), types.NamespacedName{Name: cr.Name + "-app", Namespace: cr.Namespace}, deployment); err != nil && !errors.IsNotFound(err) {
+				return 0, err
+			} else if err == nil && (deployment.Spec.Replicas == nil || *deployment.Spec.Replicas != 0 || deployment.Status.Replicas != 0) {
+				setStatus(r, cr, "Pending", "Upgrading to "+upgrade.TargetVersion+": stopping application")
+				return upgradePollInterval, nil
+			}
+			upgrade.Stopped = true
+			upgrade.PhaseStarted = metav1.Now()
+			return upgradePollInterval, nil
+		}
+		// The single replica resolves the tag; further replicas run the same digest
+		digest, err := runningImage(r, cr, "app", "horreum", r.mirrorImage(appImage(cr, r)))
+		if err != nil {
+			return 0, err
+		} else if digest == "" {
+			return waitOrRollBack(r, cr, logger, "database migration")
+		}
+		upgrade.AppImage = digest
+		setUpgradePhase(r, cr, upgradePhaseKeycloak)
+	case upgradePhaseKeycloak:
+		if keycloakDeployed(cr) {
+			digest, err := runningImage(r, cr, "keycloak", "keycloak", r.mirrorImage(keycloakImage(cr, r)))
+			if err != nil {
+				return 0, err
+			} else if digest == "" {
+				return waitOrRollBack(r, cr, logger, "Keycloak")
+			}
+			upgrade.KeycloakImage = digest
+		}
+		setUpgradePhase(r, cr, upgradePhaseApp)
+	case upgradePhaseApp:
+		recorded, err := recordCurrentVersion(r, cr)
+		if err != nil {
+			return 0, err
+		} else if recorded {
+			recordEvent(r, cr, corev1.EventTypeNormal, "Upgraded", "Upgraded to "+upgrade.TargetVersion)
+			cr.Status.Upgrade = nil
+			return 0, nil
+		}
+		return waitOrRollBack(r, cr, logger, "application")
+	case upgradePhaseRolledBack:
+		setStatus(r, cr, "Error", "Upgrade to "+upgrade.TargetVersion+" failed and was rolled back; set version to "+
+			withDefault(cr.Status.Current.Version, "empty")+" to acknowledge or to another version to retry")
+	}
+	return 0, nil
+}
+
+// waitOrRollBack polls for the component until the upgrade timeout expires and then restores the previous
+// application image. Keycloak might have migrated its database already so it stays on the new version.
+func waitOrRollBack(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, logger logr.Logger, component string) (time.Duration, error) {
+	upgrade := cr.Status.Upgrade
+	timeout := defaultUpgradeTimeout
+	if cr.Spec.UpgradeTimeout != nil {
+		timeout = cr.Spec.UpgradeTimeout.Duration
+	}
+	if time.Since(upgrade.PhaseStarted.Time) <= timeout {
+		setStatus(r, cr, "Pending", "Upgrading to "+upgrade.TargetVersion+": waiting for "+component)
+		return upgradePollInterval, nil
+	}
+	msg := "Upgrade to " + upgrade.TargetVersion + " failed: " + component + " did not become ready in " + timeout.String() +
+		", rolled back to " + withDefault(cr.Status.Current.Version, "latest")
+	if keycloakDeployed(cr) && componentUpgraded(upgrade, upgradePhaseKeycloak) {
+		cr.Status.Current.KeycloakImage = keycloakImage(cr, r)
+		msg += " except for Keycloak"
+	}
+	if upgrade.Backup != "" {
+		msg += "; database was not restored, backup is in VolumeSnapshot " + upgrade.Backup
+	}
+	logger.Info(msg)
+	recordEvent(r, cr, corev1.EventTypeWarning, "UpgradeFailed", msg)
+	upgrade.Phase = upgradePhaseRolledBack
+	upgrade.PhaseStarted = metav1.Now()
+	return 0, nil
+}
+
+// backupBeforeUpgrade snapshots database volume; returns true when the backup is complete or not possible
+func backupBeforeUpgrade(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, upgrade *hyperfoilv1alpha1.UpgradeStatus) (bool, error) {
+	if !postgresDeployed(cr) || cr.Spec.Postgres.PersistentVolumeClaim == "" {
+		return true, nil
+	}
+	if !r.SnapshotsAvailable {
+		recordEvent(r, cr, corev1.EventTypeWarning, "BackupSkipped", "VolumeSnapshot API is not available, upgrading without backup")
+		return true, nil
+	}
+	if upgrade.Backup == "" {
+		upgrade.Backup = cr.Name + "-db-" + strconv.FormatInt(upgrade.PhaseStarted.Unix(), 10)
+		if err := snapshotVolume(r, cr, cr.Spec.Postgres.PersistentVolumeClaim, upgrade.Backup); err != nil {
+			return false, err
+		}
+	}
+	ready, failure, err := snapshotReady(r, cr, upgrade.Backup)
+	if err != nil {
+		return false, err
+	} else if failure != "" {
+		// The upgrade does not proceed without backup; a new attempt is started by changing the version
+		setStatus(r, cr, "Error", "Upgrading to "+upgrade.TargetVersion+": VolumeSnapshot "+upgrade.Backup+" failed: "+failure)
+		return false, nil
+	} else if !ready {
+		return false, nil
+	}
+	lastBackup.WithLabelValues(cr.Namespace, cr.Name).SetToCurrentTime()
+	return true, nil
+}
+
+// recordCurrentVersion stores digests of the running images in status once all components run the desired images
+func recordCurrentVersion(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum) (bool, error) {
+	appDigest, err := runningImage(r, cr, "app", "horreum", r.mirrorImage(appImage(cr, r)))
+	if err != nil || appDigest == "" {
+		return false, err
+	}
+	keycloakDigest := ""
+	if keycloakDeployed(cr) {
+		keycloakDigest, err = runningImage(r, cr, "keycloak", "keycloak", r.mirrorImage(keycloakImage(cr, r)))
+		if err != nil || keycloakDigest == "" {
+			return false, err
+		}
+	}
+	cr.Status.Current = hyperfoilv1alpha1.VersionStatus{
+		Version:       cr.Spec.Version,
+		AppImage:      appDigest,
+		KeycloakImage: keycloakDigest,
+	}
+	return true, nil
+}
+
+func podsReady(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, service string, container string, image string) (bool, error) {
+	digest, err := runningImage(r, cr, service, container, image)
+	return digest != "", err
+}
+
+// runningImage finds a ready pod of the component running given image and returns the image reference by digest
+func runningImage(r *HorreumReconciler, cr *hyperfoilv1alpha1.Horreum, service string, container string, image string) (string, error) {
+	pods := &corev1.PodList{}
+	if err := r.List(context.TODO(), pods, client.InNamespace(cr.Namespace), client.MatchingLabels{"app": cr.Name, "service": service}); err != nil {
+		return "", err
+	}
+	for _, pod := range pods.Items {
+		if pod.DeletionTimestamp != nil || !isPodReady(&pod) {
+			continue
+		}
+		for _, c := range pod.Spec.Containers {
+			if c.Name != container || c.Image != image {
+				continue
+			}
+			for _, status := range pod.Status.ContainerStatuses {
+				if status.Name == container {
+					if digest := digestReference(image, status.ImageID); digest != "" {
+						return digest, nil
+					}
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+func isPodReady(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// digestReference combines repository of the image with digest from container status image ID
+// (e.g. `docker-pullable://quay.io/hyperfoil/horreum@sha256:...`)
+func digestReference(image string, imageID string) string {
+	index := strings.Index(imageID, "@sha256:")
+	if index < 0 {
+		return ""
+	}
+	repository := image
+	if at := strings.Index(repository, "@"); at >= 0 {
+		repository = repository[:at]
+	} else if colon := strings.LastIndex(repository, ":"); colon > strings.LastIndex(repository, "/") {
+		repository = repository[:colon]
+	}
+	return repository + imageID[index:]
+}
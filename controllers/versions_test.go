@@ -0,0 +1,235 @@
+package horreum
+
+import (
+	"testing"
+
+	hyperfoilv1alpha1 "github.com/Hyperfoil/horreum-operator/api/v1alpha1"
+)
+
+const testRepository = "quay.io/hyperfoil/horreum"
+
+func TestUpgradePhaseIndex(t *testing.T) {
+	tests := []struct {
+		phase string
+		want  int
+	}{
+		{upgradePhaseBackup, 0},
+		{upgradePhaseMigration, 1},
+		{upgradePhaseKeycloak, 2},
+		{upgradePhaseApp, 3},
+		{upgradePhaseRolledBack, -1},
+		{"", -1},
+	}
+	for _, tt := range tests {
+		if got := upgradePhaseIndex(tt.phase); got != tt.want {
+			t.Errorf("upgradePhaseIndex(%q) = %d, want %d", tt.phase, got, tt.want)
+		}
+	}
+}
+
+func TestComponentUpgraded(t *testing.T) {
+	tests := []struct {
+		name      string
+		upgrade   hyperfoilv1alpha1.UpgradeStatus
+		component string
+		want      bool
+	}{
+		{"app during backup", hyperfoilv1alpha1.UpgradeStatus{Phase: upgradePhaseBackup}, upgradePhaseApp, false},
+		{"keycloak during backup", hyperfoilv1alpha1.UpgradeStatus{Phase: upgradePhaseBackup}, upgradePhaseKeycloak, false},
+		{"app before stopped", hyperfoilv1alpha1.UpgradeStatus{Phase: upgradePhaseMigration}, upgradePhaseApp, false},
+		{"app migrating", hyperfoilv1alpha1.UpgradeStatus{Phase: upgradePhaseMigration, Stopped: true}, upgradePhaseApp, true},
+		{"keycloak during migration", hyperfoilv1alpha1.UpgradeStatus{Phase: upgradePhaseMigration, Stopped: true}, upgradePhaseKeycloak, false},
+		{"keycloak upgrading", hyperfoilv1alpha1.UpgradeStatus{Phase: upgradePhaseKeycloak}, upgradePhaseKeycloak, true},
+		{"app during keycloak upgrade", hyperfoilv1alpha1.UpgradeStatus{Phase: upgradePhaseKeycloak}, upgradePhaseApp, true},
+		{"keycloak during app upgrade", hyperfoilv1alpha1.UpgradeStatus{Phase: upgradePhaseApp}, upgradePhaseKeycloak, true},
+		{"app rolled back", hyperfoilv1alpha1.UpgradeStatus{Phase: upgradePhaseRolledBack}, upgradePhaseApp, false},
+		{"keycloak rolled back", hyperfoilv1alpha1.UpgradeStatus{Phase: upgradePhaseRolledBack}, upgradePhaseKeycloak, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := componentUpgraded(&tt.upgrade, tt.component); got != tt.want {
+				t.Errorf("componentUpgraded() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVersionedImage(t *testing.T) {
+	const running = testRepository + "@sha256:0000"
+	const pinned = testRepository + "@sha256:1111"
+	tests := []struct {
+		name      string
+		version   string
+		current   string
+		upgrade   *hyperfoilv1alpha1.UpgradeStatus
+		running   string
+		component string
+		want      string
+	}{
+		{
+			name:      "no version",
+			component: upgradePhaseApp,
+			want:      testRepository + ":latest",
+		},
+		{
+			name:      "first install",
+			version:   "0.7",
+			component: upgradePhaseApp,
+			want:      testRepository + ":0.7",
+		},
+		{
+			name:      "running version by digest",
+			version:   "0.7",
+			current:   "0.7",
+			running:   running,
+			component: upgradePhaseApp,
+			want:      running,
+		},
+		{
+			name:      "version changed without upgrade",
+			version:   "0.8",
+			current:   "0.7",
+			running:   running,
+			component: upgradePhaseApp,
+			want:      testRepository + ":0.8",
+		},
+		{
+			name:      "app during backup",
+			version:   "0.8",
+			current:   "0.7",
+			upgrade:   &hyperfoilv1alpha1.UpgradeStatus{TargetVersion: "0.8", Phase: upgradePhaseBackup},
+			running:   running,
+			component: upgradePhaseApp,
+			want:      running,
+		},
+		{
+			name:      "app not stopped for migration",
+			version:   "0.8",
+			current:   "0.7",
+			upgrade:   &hyperfoilv1alpha1.UpgradeStatus{TargetVersion: "0.8", Phase: upgradePhaseMigration},
+			running:   running,
+			component: upgradePhaseApp,
+			want:      running,
+		},
+		{
+			name:      "app migrating before the digest is known",
+			version:   "0.8",
+			current:   "0.7",
+			upgrade:   &hyperfoilv1alpha1.UpgradeStatus{TargetVersion: "0.8", Phase: upgradePhaseMigration, Stopped: true},
+			running:   running,
+			component: upgradePhaseApp,
+			want:      testRepository + ":0.8",
+		},
+		{
+			name:    "app migrating with pinned digest",
+			version: "0.8",
+			current: "0.7",
+			upgrade: &hyperfoilv1alpha1.UpgradeStatus{TargetVersion: "0.8", Phase: upgradePhaseMigration, Stopped: true,
+				AppImage: pinned},
+			running:   running,
+			component: upgradePhaseApp,
+			want:      pinned,
+		},
+		{
+			name:      "keycloak during migration",
+			version:   "0.8",
+			current:   "0.7",
+			upgrade:   &hyperfoilv1alpha1.UpgradeStatus{TargetVersion: "0.8", Phase: upgradePhaseMigration, Stopped: true},
+			running:   running,
+			component: upgradePhaseKeycloak,
+			want:      running,
+		},
+		{
+			name:      "keycloak upgraded with pinned digest",
+			version:   "0.8",
+			current:   "0.7",
+			upgrade:   &hyperfoilv1alpha1.UpgradeStatus{TargetVersion: "0.8", Phase: upgradePhaseApp, KeycloakImage: pinned},
+			running:   running,
+			component: upgradePhaseKeycloak,
+			want:      pinned,
+		},
+		{
+			name:      "component not running yet",
+			version:   "0.8",
+			current:   "0.7",
+			upgrade:   &hyperfoilv1alpha1.UpgradeStatus{TargetVersion: "0.8", Phase: upgradePhaseBackup},
+			component: upgradePhaseApp,
+			want:      testRepository + ":0.8",
+		},
+		{
+			name:      "version changed during upgrade",
+			version:   "0.9",
+			current:   "0.7",
+			upgrade:   &hyperfoilv1alpha1.UpgradeStatus{TargetVersion: "0.8", Phase: upgradePhaseBackup},
+			running:   running,
+			component: upgradePhaseApp,
+			want:      testRepository + ":0.9",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := &hyperfoilv1alpha1.Horreum{}
+			cr.Spec.Version = tt.version
+			cr.Status.Current.Version = tt.current
+			cr.Status.Upgrade = tt.upgrade
+			if got := versionedImage(cr, testRepository, tt.running, tt.component); got != tt.want {
+				t.Errorf("versionedImage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAppScaledDownAndMigrating(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		upgrade    *hyperfoilv1alpha1.UpgradeStatus
+		scaledDown bool
+		migrating  bool
+	}{
+		{name: "running"},
+		{name: "maintenance", mode: modeMaintenance, scaledDown: true},
+		{name: "stopped", mode: modeStopped, scaledDown: true},
+		{name: "backup", upgrade: &hyperfoilv1alpha1.UpgradeStatus{Phase: upgradePhaseBackup}},
+		{name: "stopping for migration", upgrade: &hyperfoilv1alpha1.UpgradeStatus{Phase: upgradePhaseMigration}, scaledDown: true},
+		{name: "migrating", upgrade: &hyperfoilv1alpha1.UpgradeStatus{Phase: upgradePhaseMigration, Stopped: true}, migrating: true},
+		{name: "keycloak upgrade", upgrade: &hyperfoilv1alpha1.UpgradeStatus{Phase: upgradePhaseKeycloak, Stopped: true}},
+		{name: "app upgrade", upgrade: &hyperfoilv1alpha1.UpgradeStatus{Phase: upgradePhaseApp, Stopped: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := &hyperfoilv1alpha1.Horreum{}
+			cr.Spec.Mode = tt.mode
+			cr.Status.Upgrade = tt.upgrade
+			if got := appScaledDown(cr); got != tt.scaledDown {
+				t.Errorf("appScaledDown() = %v, want %v", got, tt.scaledDown)
+			}
+			if got := appMigrating(cr); got != tt.migrating {
+				t.Errorf("appMigrating() = %v, want %v", got, tt.migrating)
+			}
+		})
+	}
+}
+
+func TestDigestReference(t *testing.T) {
+	tests := []struct {
+		image   string
+		imageID string
+		want    string
+	}{
+		{"quay.io/hyperfoil/horreum:0.7", "docker-pullable://quay.io/hyperfoil/horreum@sha256:abc", "quay.io/hyperfoil/horreum@sha256:abc"},
+		{"quay.io/hyperfoil/horreum", "quay.io/hyperfoil/horreum@sha256:abc", "quay.io/hyperfoil/horreum@sha256:abc"},
+		{"quay.io/hyperfoil/horreum@sha256:old", "quay.io/hyperfoil/horreum@sha256:abc", "quay.io/hyperfoil/horreum@sha256:abc"},
+		{"localhost:5000/horreum:0.7", "localhost:5000/horreum@sha256:abc", "localhost:5000/horreum@sha256:abc"},
+		{"localhost:5000/horreum", "localhost:5000/horreum@sha256:abc", "localhost:5000/horreum@sha256:abc"},
+		// Mirrored image keeps the repository it was pulled from
+		{"registry.local/horreum:0.7", "quay.io/hyperfoil/horreum@sha256:abc", "registry.local/horreum@sha256:abc"},
+		{"quay.io/hyperfoil/horreum:0.7", "sha256:abc", ""},
+		{"quay.io/hyperfoil/horreum:0.7", "", ""},
+	}
+	for _, tt := range tests {
+		if got := digestReference(tt.image, tt.imageID); got != tt.want {
+			t.Errorf("digestReference(%q, %q) = %q, want %q", tt.image, tt.imageID, got, tt.want)
+		}
+	}
+}
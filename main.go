@@ -19,6 +19,7 @@ package main
 import (
 	"flag"
 	"os"
+	"strings"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -29,6 +30,7 @@ import (
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
@@ -55,8 +57,16 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var imageMirrors string
+	var imageProfile string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	flag.StringVar(&imageMirrors, "image-mirrors", os.Getenv("IMAGE_MIRRORS"),
+		"Comma-separated list of source=mirror registry or repository prefixes replaced in all images, "+
+			"e.g. quay.io/hyperfoil=registry.local/hyperfoil. Defaults to IMAGE_MIRRORS environment variable.")
+	flag.StringVar(&imageProfile, "postgres-image-profile", os.Getenv("POSTGRES_IMAGE_PROFILE"),
+		"Default PostgreSQL image profile (upstream, redhat or bitnami) for resources that do not set it. "+
+			"Defaults to POSTGRES_IMAGE_PROFILE environment variable, or detection of the platform.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
@@ -68,20 +78,46 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	mirrors, err := horreum.ParseImageMirrors(imageMirrors)
+	if err != nil {
+		setupLog.Error(err, "invalid image mirrors")
+		os.Exit(1)
+	}
+
+	if imageProfile != "" && !horreum.IsImageProfile(imageProfile) {
+		setupLog.Error(nil, "invalid PostgreSQL image profile "+imageProfile)
+		os.Exit(1)
+	}
+
+	watchNamespaces := getWatchNamespaces()
+	options := ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
 		Port:                   9443,
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "ac631cda.hyperfoil.io",
-	})
+	}
+	switch len(watchNamespaces) {
+	case 0:
+		setupLog.Info("Watching all namespaces")
+	case 1:
+		setupLog.Info("Watching namespace " + watchNamespaces[0])
+		options.Namespace = watchNamespaces[0]
+	default:
+		setupLog.Info("Watching namespaces " + strings.Join(watchNamespaces, ", "))
+		options.NewCache = cache.MultiNamespacedCacheBuilder(watchNamespaces)
+	}
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), options)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
 	routesAvailable := false
+	monitoringAvailable := false
+	snapshotsAvailable := false
+	mirrorPoliciesAvailable := false
 	config, err := ctrl.GetConfig()
 	if err == nil && config != nil {
 		dclient, err := discovery.NewDiscoveryClientForConfig(config)
@@ -91,10 +127,19 @@ func main() {
 				setupLog.Error(err, "Error while querying ServerGroups, assuming we're on Vanilla Kubernetes")
 			} else {
 				for i := 0; i < len(apiGroupList.Groups); i++ {
-					if apiGroupList.Groups[i].Name == "route.openshift.io" {
+					switch apiGroupList.Groups[i].Name {
+					case "route.openshift.io":
 						routesAvailable = true
 						setupLog.Info("We found route.openshift.io, assuming we're on OpenShift.")
-						break
+					case "monitoring.coreos.com":
+						monitoringAvailable = true
+						setupLog.Info("We found monitoring.coreos.com, ServiceMonitors and PrometheusRules can be created.")
+					case "operator.openshift.io":
+						mirrorPoliciesAvailable = true
+						setupLog.Info("We found operator.openshift.io, ImageContentSourcePolicies will be applied to images referenced by tag.")
+					case "snapshot.storage.k8s.io":
+						snapshotsAvailable = true
+						setupLog.Info("We found snapshot.storage.k8s.io, database volumes can be snapshotted.")
 					}
 				}
 			}
@@ -106,15 +151,30 @@ func main() {
 	}
 
 	if err = (&horreum.HorreumReconciler{
-		Client:          mgr.GetClient(),
-		Scheme:          mgr.GetScheme(),
-		Log:             ctrl.Log.WithName("controllers").WithName("Horreum"),
-		RoutesAvailable: routesAvailable,
-		UseRedHatImages: routesAvailable,
+		Client:                  mgr.GetClient(),
+		APIReader:               mgr.GetAPIReader(),
+		Scheme:                  mgr.GetScheme(),
+		Log:                     ctrl.Log.WithName("controllers").WithName("Horreum"),
+		Recorder:                mgr.GetEventRecorderFor("horreum-controller"),
+		RoutesAvailable:         routesAvailable,
+		MonitoringAvailable:     monitoringAvailable,
+		SnapshotsAvailable:      snapshotsAvailable,
+		ImageMirrors:            mirrors,
+		MirrorPoliciesAvailable: mirrorPoliciesAvailable,
+		OpenShift:               routesAvailable,
+		DefaultImageProfile:     imageProfile,
+		WatchNamespaces:         watchNamespaces,
+		OperatorNamespace:       os.Getenv("POD_NAMESPACE"),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Horreum")
 		os.Exit(1)
 	}
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&hyperfoiliov1alpha1.Horreum{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Horreum")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -132,3 +192,15 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// getWatchNamespaces returns namespaces from comma-separated WATCH_NAMESPACE environment variable;
+// empty list means all namespaces. OLM sets the variable according to the install mode.
+func getWatchNamespaces() []string {
+	namespaces := []string{}
+	for _, ns := range strings.Split(os.Getenv("WATCH_NAMESPACE"), ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	return namespaces
+}